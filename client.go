@@ -0,0 +1,297 @@
+package wsbeam
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var (
+	// ErrDisconnected is returned when sending data to a client that is no longer connected.
+	ErrDisconnected = errors.New("client is disconnected")
+	// ErrBufferFull is returned when sending data to a client which its buffer is full.
+	ErrBufferFull = errors.New("client buffer is full")
+	// errServed is returned when serving or closing a client that is already served or closed.
+	errServed = errors.New("client is already served or closed")
+)
+
+// Client is a handle to a single connection of a beam (a pear).
+type Client struct {
+	// active is the time of the last message that was written to or read from the connection, in
+	// unix nanoseconds. It is accessed atomically, and is the first field to guarantee its
+	// alignment.
+	active int64
+	// acked is the last sequence number that the client acknowledged. It is accessed atomically.
+	acked uint64
+	// connected is 1 while the client is in the beam. It is accessed atomically.
+	connected int32
+	// served is 1 once the client is served or closed. It is accessed atomically.
+	served int32
+
+	beam *Beam
+	// queue is the buffer of messages that were not yet written to the connection.
+	queue *queue
+	addr  string
+	// ip is the client IP, when connections are limited per IP.
+	ip string
+	// shard is the shard that the client is stored in.
+	shard *shard
+	// connectedAt is the time that the client was added to the beam.
+	connectedAt time.Time
+	// conn is the websocket connection. It is nil for SSE connections.
+	conn *websocket.Conn
+	// reads is the channel of the goroutine that reads from the connection (see `clientClosed`). It
+	// is nil if the connection is not read.
+	reads <-chan error
+	// topics are the topics that the client is subscribed to.
+	topics []string
+	// tags are the tags that the server assigned to the client.
+	tags []string
+	// compressed is set if compression was negotiated with the client.
+	compressed bool
+	// replay is set if the client requested to replay the history.
+	replay bool
+	// tls is the TLS state of the connection request. It is nil for connections without TLS.
+	tls *tls.ConnectionState
+	// metadata is the connection metadata.
+	metadata map[string]interface{}
+	// resumeToken is the token that the client can use to resume the connection. It is empty if
+	// connections are not resumable.
+	resumeToken string
+	// resumeFrom is the resume token that the client requested to resume.
+	resumeFrom string
+	// key identifies the client for evicting older connections with the same key.
+	key string
+	// termination describes how the server terminated the connection. It is set before closing is
+	// closed.
+	termination termination
+	// ctx is the connection context. The connection is closed when it is done.
+	ctx context.Context
+	// closing is closed when the connection should be terminated by the server.
+	closing chan struct{}
+	// done is closed when the connection is no longer served.
+	done     chan struct{}
+	doneOnce sync.Once
+}
+
+// Connected returns whether the client is still connected to the beam. Once it returns false, the
+// client will not receive any more messages.
+func (c *Client) Connected() bool {
+	return atomic.LoadInt32(&c.connected) == 1
+}
+
+// Serve writes the messages of the beam to the client connection, until it is disconnected, and
+// returns the disconnection reason (see `OptOnDisconnect`). It should be called once for a client
+// that was returned by `Beam.Upgrade`, and returns an error without serving for any other client.
+func (c *Client) Serve() error {
+	if c.conn == nil || !atomic.CompareAndSwapInt32(&c.served, 0, 1) {
+		return errServed
+	}
+	b := c.beam
+	defer c.release()
+
+	if b.onConnect != nil {
+		b.onConnect(c)
+	}
+
+	reason := b.serve(c, c.conn, c.reads)
+	b.remove(c)
+	if b.onDisconnect != nil {
+		b.onDisconnect(c, reason)
+	}
+	return reason
+}
+
+// Close removes the client from the beam and closes its connection, without serving it. It can be
+// called, instead of `Serve`, for a client that was returned by `Beam.Upgrade`, and returns an error
+// for any other client. The connect and disconnect functions are not called for a closed client.
+func (c *Client) Close() error {
+	if c.conn == nil || !atomic.CompareAndSwapInt32(&c.served, 0, 1) {
+		return errServed
+	}
+	b := c.beam
+	b.remove(c)
+	b.closeHandshake(c, c.conn, c.reads, b.closeCode, b.closeText)
+	c.release()
+	return nil
+}
+
+// release closes the connection of the client, waits for the reading goroutine to exit, and
+// removes the client from the beam.
+func (c *Client) release() {
+	c.conn.Close()
+	if c.reads != nil {
+		<-c.reads
+	}
+	c.beam.logLevel(LogDebug, c, "Disconnected", nil)
+	c.beam.remove(c)
+}
+
+// Ack records that the client received the messages up to the given sequence number, such that
+// `Beam.SendFrom` does not send it older messages. It is typically called from the message function
+// (see `OptOnMessage`), when the client reports the last sequence number that it received. The
+// acknowledged sequence number never decreases.
+func (c *Client) Ack(seq uint64) {
+	for {
+		acked := atomic.LoadUint64(&c.acked)
+		if seq <= acked || atomic.CompareAndSwapUint64(&c.acked, acked, seq) {
+			return
+		}
+	}
+}
+
+// Acked returns the last sequence number that the client acknowledged (see `Ack`).
+func (c *Client) Acked() uint64 {
+	return atomic.LoadUint64(&c.acked)
+}
+
+// Age returns the time since the client was connected to the beam.
+func (c *Client) Age() time.Duration {
+	return time.Since(c.connectedAt)
+}
+
+// Addr returns the remote address of the client.
+func (c *Client) Addr() string {
+	return c.addr
+}
+
+// QueueLen returns the number of messages that are buffered for the client and were not yet written
+// to its connection.
+func (c *Client) QueueLen() int {
+	return c.queue.len()
+}
+
+// QueueCap returns the maximum number of messages that can be buffered for the client. When the
+// buffer is grown on demand (see `OptDynamicBuffer`), it is the maximum size of the buffer.
+func (c *Client) QueueCap() int {
+	return c.queue.max
+}
+
+// Conn returns the underlying websocket connection of the client, for using connection methods
+// that the beam does not wrap, such as `LocalAddr` or `SetCompressionLevel`. It is nil for SSE
+// connections. The beam writes to the connection from its own goroutine, and, when disconnections
+// are detected with a read loop, also reads from it (see `OptDisconnectDetection`). Gorilla
+// connections support only a single concurrent writer and reader, so writing messages to the
+// connection or reading from it directly may corrupt the frame stream, and messages should be sent
+// with `Send` instead. Methods that are safe for concurrent use, such as `WriteControl`, can be
+// called.
+func (c *Client) Conn() *websocket.Conn {
+	return c.conn
+}
+
+// Subprotocol returns the subprotocol that was negotiated with the client (see
+// `OptSubprotocols`). It is empty if no subprotocol was negotiated, or for SSE connections.
+func (c *Client) Subprotocol() string {
+	if c.conn == nil {
+		return ""
+	}
+	return c.conn.Subprotocol()
+}
+
+// Compressed returns whether the permessage-deflate extension was negotiated with the client (see
+// `OptCompression`). It is false for SSE connections.
+func (c *Client) Compressed() bool {
+	return c.compressed
+}
+
+// TLS returns the TLS state of the connection request, as it was when the client connected. It is
+// nil if the client did not connect with TLS.
+func (c *Client) TLS() *tls.ConnectionState {
+	return c.tls
+}
+
+// PeerCommonName returns the subject common name of the verified client certificate. It is empty if
+// the client did not connect with TLS, or did not present a verified certificate.
+func (c *Client) PeerCommonName() string {
+	if c.tls == nil || len(c.tls.VerifiedChains) == 0 || len(c.tls.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return c.tls.VerifiedChains[0][0].Subject.CommonName
+}
+
+// ResumeToken returns the token that the client can use to resume the connection after it is
+// disconnected (see `OptResumable`). It is empty if connections are not resumable.
+func (c *Client) ResumeToken() string {
+	return c.resumeToken
+}
+
+// Topics returns the topics that the client is subscribed to.
+func (c *Client) Topics() []string {
+	return c.topics
+}
+
+// Tags returns the tags of the client, as returned by the function that was given to `OptTags`.
+func (c *Client) Tags() []string {
+	return c.tags
+}
+
+// Metadata returns the connection metadata, as returned by the function that was given to
+// `OptConnectMetadata`.
+func (c *Client) Metadata() map[string]interface{} {
+	return c.metadata
+}
+
+// touch records activity of the client.
+func (c *Client) touch() {
+	atomic.StoreInt64(&c.active, time.Now().UnixNano())
+}
+
+// idleFor returns the time since the last activity of the client.
+func (c *Client) idleFor() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&c.active)))
+}
+
+// subscribed returns whether one of the client subscriptions matches the given topic.
+func (c *Client) subscribed(topic string) bool {
+	for _, t := range c.topics {
+		if matchTopic(t, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// tagged returns whether the client has the given tag.
+func (c *Client) tagged(tag string) bool {
+	for _, t := range c.tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// matchTopic returns whether a subscription matches a topic. A subscription that ends with "*"
+// matches any topic that starts with the rest of the subscription, and any other subscription
+// matches only the exact topic.
+func matchTopic(subscription, topic string) bool {
+	if strings.HasSuffix(subscription, "*") {
+		return strings.HasPrefix(topic, strings.TrimSuffix(subscription, "*"))
+	}
+	return subscription == topic
+}
+
+// Send the data only to this client. It returns `ErrDisconnected` if the client is no longer
+// connected, or `ErrBufferFull` if the client did not read enough of the previous messages.
+func (c *Client) Send(data interface{}) error {
+	msg, err := c.beam.prepare(data)
+	if err != nil {
+		return err
+	}
+
+	c.shard.lock.RLock()
+	defer c.shard.lock.RUnlock()
+	if !c.shard.pears[c] {
+		return ErrDisconnected
+	}
+	if !c.queue.push(msg) {
+		return ErrBufferFull
+	}
+	return nil
+}
@@ -1,8 +1,17 @@
 module github.com/posener/wsbeam
 
-go 1.15
+go 1.18
 
 require (
 	github.com/gorilla/websocket v1.4.2
 	github.com/stretchr/testify v1.4.0
+	go.uber.org/goleak v1.1.10
+)
+
+require (
+	github.com/davecgh/go-spew v1.1.0 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	golang.org/x/lint v0.0.0-20190930215403-16217165b5de // indirect
+	golang.org/x/tools v0.0.0-20191108193012-7d206e10da11 // indirect
+	gopkg.in/yaml.v2 v2.2.2 // indirect
 )
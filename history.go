@@ -0,0 +1,37 @@
+package wsbeam
+
+// history is a ring buffer of the last messages that were sent to all the pears. It is not safe for
+// concurrent use.
+type history struct {
+	// buf holds n messages, starting at head.
+	buf  []*message
+	head int
+	n    int
+}
+
+func newHistory(size int) *history {
+	return &history{buf: make([]*message, size)}
+}
+
+// add adds a message to the history, replacing the oldest message if the history is full.
+func (h *history) add(msg *message) {
+	if len(h.buf) == 0 {
+		return
+	}
+	if h.n < len(h.buf) {
+		h.buf[(h.head+h.n)%len(h.buf)] = msg
+		h.n++
+		return
+	}
+	h.buf[h.head] = msg
+	h.head = (h.head + 1) % len(h.buf)
+}
+
+// messages returns the messages in the history, from the oldest to the newest.
+func (h *history) messages() []*message {
+	msgs := make([]*message, h.n)
+	for i := range msgs {
+		msgs[i] = h.buf[(h.head+i)%len(h.buf)]
+	}
+	return msgs
+}
@@ -0,0 +1,41 @@
+package wsbeam
+
+import (
+	"net/http"
+	"sync"
+)
+
+// Mux is an HTTP handler that routes connections to one of several beams, such that a single
+// endpoint serves multiple logical streams. Clients choose the beam with the "stream" URL query
+// parameter, for example: "/ws?stream=foo". It is safe for concurrent use.
+type Mux struct {
+	beams map[string]*Beam
+	lock  sync.RWMutex
+}
+
+// NewMux returns a new Mux without beams.
+func NewMux() *Mux {
+	return &Mux{beams: map[string]*Beam{}}
+}
+
+// Add adds a beam that serves connections with the given stream name. It replaces any beam that was
+// added with the same name. Connections that are already served by the replaced beam are not
+// affected.
+func (m *Mux) Add(name string, b *Beam) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.beams[name] = b
+}
+
+// ServeHTTP serves the connection with the beam of the requested stream. Requests for an unknown
+// stream are rejected with HTTP 404 status.
+func (m *Mux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.lock.RLock()
+	b := m.beams[r.URL.Query().Get("stream")]
+	m.lock.RUnlock()
+	if b == nil {
+		http.NotFound(w, r)
+		return
+	}
+	b.ServeHTTP(w, r)
+}
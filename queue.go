@@ -0,0 +1,273 @@
+package wsbeam
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// queue is the message buffer of a single pear. It is a ring buffer that its capacity can grow on
+// demand, up to a maximum size, and shrink back when the pear catches up. When the minimum and
+// maximum sizes are equal, the queue has a fixed size. A consumer should wait for messages on both
+// the out channel, which hands off messages directly when the consumer is waiting on an empty
+// queue, just like an unbuffered channel, and the ready channel, which signals that messages can be
+// popped. It is safe for concurrent use.
+type queue struct {
+	lock sync.Mutex
+	// buf holds n messages, starting at head.
+	buf  []*message
+	head int
+	n    int
+	min  int
+	max  int
+	// limit is the limit of the total size of the messages in the queues of a beam. It is nil if
+	// there is no limit.
+	limit *bufferLimit
+	// dropOldest makes push discard the oldest message when the queue is full, instead of the new
+	// message.
+	dropOldest bool
+	// congested is set when the queue gets full, and is cleared when it drains to half of its
+	// maximum size, at which point onRecover is called, if it is set.
+	congested bool
+	onRecover func()
+	// onEvict is called, if it is set, with the oldest message when it is discarded for a new
+	// message.
+	onEvict func(*message)
+
+	// out hands off messages to a waiting consumer.
+	out chan *message
+	// ready receives a value when messages are pushed to the queue.
+	ready chan struct{}
+	// space receives a value when messages are popped from the queue.
+	space chan struct{}
+}
+
+func newQueue(min, max int) *queue {
+	return &queue{
+		buf:   make([]*message, min),
+		min:   min,
+		max:   max,
+		out:   make(chan *message),
+		ready: make(chan struct{}, 1),
+		space: make(chan struct{}, 1),
+	}
+}
+
+// push adds a message to the queue, growing it if needed. It returns false if a message was
+// discarded because the queue is full: the new message, or, if dropOldest is set, the oldest message
+// in the queue, in which case the new message was added. Use pushReport to tell the two apart.
+func (q *queue) push(msg *message) bool {
+	_, ok := q.insert(msg, q.dropOldest, true)
+	return ok
+}
+
+// pushReport adds a message to the queue, as push does, and reports both whether the new message was
+// added, and whether no message was discarded.
+func (q *queue) pushReport(msg *message) (added, ok bool) {
+	return q.insert(msg, q.dropOldest, true)
+}
+
+// insert adds a message to the queue, growing it if needed. If the queue is full, it discards the
+// oldest message if evict is set, or the new message otherwise. Evicting is done while holding the
+// lock, such that a consumer that pops concurrently either gets the oldest message before it is
+// evicted, or the next one, and messages are never reordered. If limit is set, the new message is
+// also discarded if it exceeds the limit of the total size of the buffered messages. It returns
+// whether the new message was added, and whether no message was discarded.
+func (q *queue) insert(msg *message, evict, limit bool) (added, ok bool) {
+	q.lock.Lock()
+	// Hand off the message to a waiting consumer. The lock is held to keep the messages order.
+	if q.n == 0 {
+		select {
+		case q.out <- msg:
+			q.lock.Unlock()
+			return true, true
+		default:
+		}
+	}
+	size := int64(len(msg.data))
+	if limit {
+		if !q.limit.reserve(size) {
+			q.lock.Unlock()
+			return false, false
+		}
+	} else {
+		q.limit.add(size)
+	}
+	if q.n == len(q.buf) && !q.resize(2*len(q.buf)) {
+		q.congested = true
+		if !evict || q.n == 0 {
+			q.limit.add(-size)
+			q.lock.Unlock()
+			return false, false
+		}
+		// Replace the oldest message by the new message at the end of the queue.
+		old := q.buf[q.head]
+		q.limit.add(-int64(len(old.data)))
+		q.buf[q.head] = msg
+		q.head = (q.head + 1) % len(q.buf)
+		q.lock.Unlock()
+		if q.onEvict != nil {
+			q.onEvict(old)
+		}
+		notify(q.ready)
+		return true, false
+	}
+	q.buf[(q.head+q.n)%len(q.buf)] = msg
+	q.n++
+	if q.n == q.max {
+		q.congested = true
+	}
+	q.lock.Unlock()
+
+	notify(q.ready)
+	return true, true
+}
+
+// pushWait adds a message to the queue, and if it is full, waits until it has room for it, without
+// discarding any message. The size of the message is not limited, since the queue may be empty
+// while the messages of other queues exceed the limit. It returns false if done was closed before
+// the message was added.
+func (q *queue) pushWait(msg *message, done <-chan struct{}) bool {
+	for {
+		if added, _ := q.insert(msg, false, false); added {
+			return true
+		}
+		select {
+		case <-q.space:
+		case <-done:
+			return false
+		}
+	}
+}
+
+// pop removes the first message of the queue, shrinking it if it is mostly empty. It returns false
+// if the queue is empty.
+func (q *queue) pop() (*message, bool) {
+	q.lock.Lock()
+	if q.n == 0 {
+		q.lock.Unlock()
+		return nil, false
+	}
+	msg := q.buf[q.head]
+	q.buf[q.head] = nil
+	q.head = (q.head + 1) % len(q.buf)
+	q.n--
+	q.limit.add(-int64(len(msg.data)))
+	if q.n <= len(q.buf)/4 {
+		q.resize(len(q.buf) / 2)
+	}
+	more := q.n > 0
+	recovered := q.congested && q.n <= q.max/2
+	if recovered {
+		q.congested = false
+	}
+	q.lock.Unlock()
+
+	if recovered && q.onRecover != nil {
+		q.onRecover()
+	}
+
+	// Keep the consumer going while there are more messages.
+	if more {
+		notify(q.ready)
+	}
+	notify(q.space)
+	return msg, true
+}
+
+// clear removes all the messages from the queue.
+func (q *queue) clear() {
+	q.drain()
+}
+
+// drain removes all the messages from the queue, and returns them.
+func (q *queue) drain() []*message {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	msgs := make([]*message, 0, q.n)
+	for ; q.n > 0; q.n-- {
+		msg := q.buf[q.head]
+		q.limit.add(-int64(len(msg.data)))
+		msgs = append(msgs, msg)
+		q.buf[q.head] = nil
+		q.head = (q.head + 1) % len(q.buf)
+	}
+	return msgs
+}
+
+// len returns the number of messages in the queue.
+func (q *queue) len() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.n
+}
+
+// fill returns the ratio between the number of messages in the queue and its maximum size.
+func (q *queue) fill() float64 {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.max == 0 {
+		return 0
+	}
+	return float64(q.n) / float64(q.max)
+}
+
+// resize changes the capacity of the queue, within its minimum and maximum sizes. It returns false
+// if the capacity was not changed. It should be called while holding the lock.
+func (q *queue) resize(size int) bool {
+	if size < 1 {
+		size = 1
+	}
+	if size > q.max {
+		size = q.max
+	}
+	if size < q.min {
+		size = q.min
+	}
+	if size == len(q.buf) || size < q.n {
+		return false
+	}
+	buf := make([]*message, size)
+	for i := 0; i < q.n; i++ {
+		buf[i] = q.buf[(q.head+i)%len(q.buf)]
+	}
+	q.buf = buf
+	q.head = 0
+	return true
+}
+
+// notify sends a value on a signal channel without blocking.
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// bufferLimit limits the total size of the messages in the queues of a beam. It is safe for
+// concurrent use.
+type bufferLimit struct {
+	// used is the total size of the buffered messages, in bytes. It is accessed atomically, and is
+	// the first field to guarantee its alignment.
+	used int64
+	max  int64
+}
+
+// reserve adds n bytes to the used bytes, if they don't exceed the limit. It returns false if the
+// bytes exceed the limit. A nil limit is never exceeded.
+func (l *bufferLimit) reserve(n int64) bool {
+	if l == nil {
+		return true
+	}
+	if atomic.AddInt64(&l.used, n) > l.max {
+		atomic.AddInt64(&l.used, -n)
+		return false
+	}
+	return true
+}
+
+// add adds n bytes, which may be negative, to the used bytes, regardless of the limit.
+func (l *bufferLimit) add(n int64) {
+	if l != nil {
+		atomic.AddInt64(&l.used, n)
+	}
+}
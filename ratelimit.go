@@ -0,0 +1,85 @@
+package wsbeam
+
+import "time"
+
+// limiter is a token bucket rate limiter, which allows a burst of up to a given number of events.
+// It is not safe for concurrent use.
+type limiter struct {
+	// rate is the number of events that are allowed per second.
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newLimiter(rate, burst int) *limiter {
+	return &limiter{rate: float64(rate), burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// allow reports whether an event may happen at the given time, and consumes a token if it may.
+func (l *limiter) allow(now time.Time) bool {
+	l.refill(now)
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// delay returns the time from the given time until an event may happen.
+func (l *limiter) delay(now time.Time) time.Duration {
+	l.refill(now)
+	if l.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+}
+
+// refill adds the tokens that accumulated since the last event.
+func (l *limiter) refill(now time.Time) {
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+}
+
+// pacer paces the messages that are written to a pear (see `OptSendRateLimit`). The writing loop
+// should receive messages from its out and ready channels, which are nil while the writes are
+// paused, and call unpause when the resume channel fires.
+type pacer struct {
+	queue *queue
+	// limit is nil if the rate is not limited.
+	limit *limiter
+	out   <-chan *message
+	ready <-chan struct{}
+	// resume fires when the writes can be resumed. It is nil while they are not paused.
+	resume <-chan time.Time
+}
+
+func (b *Beam) newPacer(q *queue) *pacer {
+	p := &pacer{queue: q, out: q.out, ready: q.ready}
+	if b.sendRate > 0 {
+		p.limit = newLimiter(b.sendRate, 1)
+	}
+	return p
+}
+
+// wrote records that a message was written, and pauses the writes if the rate is exceeded.
+func (p *pacer) wrote() {
+	if p.limit == nil {
+		return
+	}
+	now := time.Now()
+	p.limit.allow(now)
+	if d := p.limit.delay(now); d > 0 {
+		p.out, p.ready = nil, nil
+		p.resume = time.After(d)
+	}
+}
+
+// unpause resumes the writes.
+func (p *pacer) unpause() {
+	p.out, p.ready = p.queue.out, p.queue.ready
+	p.resume = nil
+}
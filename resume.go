@@ -0,0 +1,68 @@
+package wsbeam
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+)
+
+// ResumeHeader is the HTTP response header of a connection request that holds the token that the
+// client can use to resume the connection (see `OptResumable`).
+const ResumeHeader = "Wsbeam-Resume-Token"
+
+// resumeTokenSize is the number of random bytes in a resume token.
+const resumeTokenSize = 16
+
+// suspended holds the messages that were not written to a disconnected pear, until it resumes the
+// connection or the timer expires.
+type suspended struct {
+	messages []*message
+	timer    *time.Timer
+}
+
+// newResumeToken returns a new random resume token.
+func newResumeToken() string {
+	buf := make([]byte, resumeTokenSize)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf)
+}
+
+// suspend stores the messages that were not written to a disconnected pear under its resume token.
+// It should be called after the pear was removed, such that no more messages are added to its
+// queue.
+func (b *Beam) suspend(p *Client) {
+	msgs := p.queue.drain()
+	if len(msgs) == 0 {
+		return
+	}
+	s := &suspended{messages: msgs}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.closed {
+		return
+	}
+	token := p.resumeToken
+	b.suspended[token] = s
+	s.timer = time.AfterFunc(b.resumeTTL, func() {
+		b.lock.Lock()
+		defer b.lock.Unlock()
+		if b.suspended[token] == s {
+			delete(b.suspended, token)
+		}
+	})
+}
+
+// resumeLocked returns the messages that were stored for the resume token that a new pear
+// requested, and discards them from the beam. It should be called while holding the lock.
+func (b *Beam) resumeLocked(p *Client) []*message {
+	s := b.suspended[p.resumeFrom]
+	if s == nil {
+		return nil
+	}
+	s.timer.Stop()
+	delete(b.suspended, p.resumeFrom)
+	return s.messages
+}
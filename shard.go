@@ -0,0 +1,261 @@
+package wsbeam
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// shardCount is the number of shards that the pears of a beam are divided between.
+const shardCount = 32
+
+// shard is a subset of the pears of a beam, protected by its own lock. Sending messages only reads
+// the pears, and channels are safe for concurrent use, so sends take only a read lock.
+type shard struct {
+	pears map[*Client]bool
+	lock  sync.RWMutex
+}
+
+func newShards(n int) []shard {
+	shards := make([]shard, n)
+	for i := range shards {
+		shards[i].pears = map[*Client]bool{}
+	}
+	return shards
+}
+
+// each calls fn for every pear, while holding the read lock of the pear's shard. The iteration
+// stops if fn returns false.
+func (b *Beam) each(fn func(p *Client) bool) {
+	for i := range b.shards {
+		s := &b.shards[i]
+		s.lock.RLock()
+		for p := range s.pears {
+			if !fn(p) {
+				s.lock.RUnlock()
+				return
+			}
+		}
+		s.lock.RUnlock()
+	}
+}
+
+// eachParallel calls fn for every pear, as each does, but divides the shards between the send
+// workers (see `OptParallelSend`), such that fn may be called concurrently. The iteration stops if fn
+// returns false.
+func (b *Beam) eachParallel(fn func(p *Client) bool) {
+	if b.sendWorkers <= 1 {
+		b.each(fn)
+		return
+	}
+
+	var (
+		next    uint32
+		stopped int32
+		wg      sync.WaitGroup
+	)
+	for w := 0; w < b.sendWorkers && w < len(b.shards); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for atomic.LoadInt32(&stopped) == 0 {
+				i := int(atomic.AddUint32(&next, 1)) - 1
+				if i >= len(b.shards) {
+					return
+				}
+				s := &b.shards[i]
+				s.lock.RLock()
+				for p := range s.pears {
+					if atomic.LoadInt32(&stopped) == 1 || !fn(p) {
+						atomic.StoreInt32(&stopped, 1)
+						break
+					}
+				}
+				s.lock.RUnlock()
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// reserve reserves a place for a new pear, before its connection is upgraded. It fails if the beam
+// is closed, if it has too many connections, or if the pear's IP has too many connections. A
+// successful reservation should be followed by either add or release.
+func (b *Beam) reserve(p *Client) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.closed {
+		return ErrClosed
+	}
+	if b.maxConnections > 0 && b.Count()+b.pending >= b.maxConnections {
+		return errMaxConnections
+	}
+	if p.ip != "" {
+		if b.ips[p.ip] >= b.maxConnectionsPerIP {
+			return errMaxConnectionsPerIP
+		}
+		b.ips[p.ip]++
+	}
+	b.pending++
+	return nil
+}
+
+// release releases a reservation of a pear that was not added.
+func (b *Beam) release(p *Client) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.pending--
+	b.releaseIPLocked(p)
+}
+
+// releaseIPLocked releases the place of a pear in the connection count of its IP. It should be
+// called while holding the beam lock.
+func (b *Beam) releaseIPLocked(p *Client) {
+	if p.ip == "" {
+		return
+	}
+	if b.ips[p.ip]--; b.ips[p.ip] <= 0 {
+		delete(b.ips, p.ip)
+	}
+}
+
+// add adds a pear that its place was reserved to the beam. It fails if the beam was closed since
+// the reservation.
+func (b *Beam) add(p *Client) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.pending--
+	if b.closed {
+		b.releaseIPLocked(p)
+		return ErrClosed
+	}
+
+	// Send the resumed messages, and the history or the retained message to the new pear, before
+	// any other message can be sent to it.
+	for _, msg := range b.resumeLocked(p) {
+		p.queue.push(msg)
+	}
+	if p.replay && b.history != nil {
+		for _, msg := range b.history.messages() {
+			p.queue.push(msg)
+		}
+	} else if b.retained != nil {
+		p.queue.push(b.retained)
+	}
+
+	// Evict an existing pear with the same key, before the new pear is added.
+	if p.key != "" {
+		if old := b.keys[p.key]; old != nil {
+			old.shard.lock.Lock()
+			b.terminateLocked(old, termination{
+				reason: ErrEvicted,
+				code:   websocket.ClosePolicyViolation,
+				text:   ErrEvicted.Error(),
+				event:  "Evicted",
+			})
+			old.shard.lock.Unlock()
+		}
+		b.keys[p.key] = p
+	}
+
+	p.shard = &b.shards[atomic.AddUint32(&b.nextShard, 1)%uint32(len(b.shards))]
+	p.shard.lock.Lock()
+	defer p.shard.lock.Unlock()
+	p.connectedAt = time.Now()
+	p.shard.pears[p] = true
+	atomic.StoreInt32(&p.connected, 1)
+	atomic.AddInt64(&b.count, 1)
+	atomic.AddUint64(&b.totalConnections, 1)
+	return nil
+}
+
+// remove removes a pear that was added from the beam. It is safe to call it more than once.
+func (b *Beam) remove(p *Client) {
+	// Mark the pear as done before taking the lock, to release any operation that waits for it
+	// while holding the lock.
+	first := false
+	p.doneOnce.Do(func() {
+		close(p.done)
+		first = true
+	})
+	defer func() {
+		// Keep or release the messages that were not written, after the pear can no longer receive
+		// messages.
+		if !first {
+			return
+		}
+		if p.resumeToken != "" {
+			b.suspend(p)
+		} else {
+			p.queue.clear()
+		}
+	}()
+
+	if first && (p.key != "" || p.ip != "") {
+		b.lock.Lock()
+		if p.key != "" && b.keys[p.key] == p {
+			delete(b.keys, p.key)
+		}
+		b.releaseIPLocked(p)
+		b.lock.Unlock()
+	}
+
+	p.shard.lock.Lock()
+	defer p.shard.lock.Unlock()
+	b.removeLocked(p)
+}
+
+// removeLocked removes a pear from its shard. It should be called while holding the shard lock.
+func (b *Beam) removeLocked(p *Client) {
+	if !p.shard.pears[p] {
+		return
+	}
+	delete(p.shard.pears, p)
+	atomic.StoreInt32(&p.connected, 0)
+	atomic.AddInt64(&b.count, -1)
+}
+
+// termination describes how the server terminates the connection of a pear.
+type termination struct {
+	// reason is the disconnection reason.
+	reason error
+	// code and text are the close message of a websocket connection.
+	code int
+	text string
+	// event is the logged event.
+	event string
+}
+
+// closeTermination returns the termination of pears of a closed beam.
+func (b *Beam) closeTermination() termination {
+	return termination{reason: ErrClosed, code: b.closeCode, text: b.closeText, event: "Beam closed"}
+}
+
+// terminateLocked terminates the connection of a pear and removes it from the beam. It should be
+// called while holding the shard lock.
+func (b *Beam) terminateLocked(p *Client, t termination) {
+	if !p.shard.pears[p] {
+		return
+	}
+	p.termination = t
+	close(p.closing)
+	b.removeLocked(p)
+}
+
+// terminateAll terminates the connections of all the pears and removes them from the beam. It
+// returns the terminated pears.
+func (b *Beam) terminateAll(t termination) []*Client {
+	var pears []*Client
+	for i := range b.shards {
+		s := &b.shards[i]
+		s.lock.Lock()
+		for p := range s.pears {
+			pears = append(pears, p)
+			b.terminateLocked(p, t)
+		}
+		s.lock.Unlock()
+	}
+	return pears
+}
@@ -0,0 +1,200 @@
+package wsbeam
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// errUnsupportedSSE is used when a message can't be sent to an SSE connection.
+var errUnsupportedSSE = errors.New("message is not supported by SSE")
+
+// SSEHandler returns an HTTP handler that serves the beam messages with Server-Sent Events, for
+// clients that can't use websocket connections, for example, due to proxies that block websocket
+// upgrades. The SSE connections are pears of the same beam, so all the beam methods apply to them
+// as well. Each message is sent as a single event of the form "data: <message>\n\n". SSE supports
+// only text, and binary messages, as well as messages that are sent with `SendPrepared`, are not
+// sent to SSE connections. The SSE connections don't read client messages, so `OptOnMessage`
+// doesn't apply to them, and when `OptPingInterval` is used, a comment is sent to keep the
+// connection alive.
+func (b *Beam) SSEHandler() http.Handler {
+	return http.HandlerFunc(b.serveSSE)
+}
+
+func (b *Beam) serveSSE(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	p, err := b.accept(w, r)
+	if err != nil {
+		return
+	}
+
+	if err := b.reserve(p); err != nil {
+		b.log(p, "Rejected connection", err)
+		b.setRetryAfter(w.Header())
+		if err == errMaxConnectionsPerIP {
+			http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+			return
+		}
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+
+	if err := b.add(p); err != nil {
+		b.log(p, "Rejected connection", err)
+		b.setRetryAfter(w.Header())
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+	defer b.remove(p)
+	defer b.logLevel(LogDebug, p, "Disconnected", nil)
+
+	h := w.Header()
+	for k, v := range b.headers {
+		h[k] = v
+	}
+	if p.resumeToken != "" {
+		h.Set(ResumeHeader, p.resumeToken)
+	}
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	if b.onConnect != nil {
+		b.onConnect(p)
+	}
+
+	reason := b.serveEvents(p, w, flusher, r.Context().Done())
+	b.remove(p)
+	if b.onDisconnect != nil {
+		b.onDisconnect(p, reason)
+	}
+}
+
+// serveEvents keeps writing events to an SSE connection until it is closed. It returns the reason
+// for the disconnection, which is nil if the client closed the connection.
+func (b *Beam) serveEvents(p *Client, w io.Writer, flusher http.Flusher, done <-chan struct{}) error {
+	if b.initialMessage != nil {
+		err := b.writeInitialEvent(p, w)
+		if err != nil {
+			b.log(p, "Failed sending initial message", err)
+			return err
+		}
+		flusher.Flush()
+	}
+
+	var ping <-chan time.Time
+	if b.pingInterval > 0 {
+		t := time.NewTicker(b.pingInterval)
+		defer t.Stop()
+		ping = t.C
+	}
+
+	idle, idleTimer := b.idleTimer(p)
+	if idleTimer != nil {
+		defer idleTimer.Stop()
+	}
+
+	pace := b.newPacer(p.queue)
+	write := func(v *message) error {
+		err := writeEvent(w, v)
+		if err == errUnsupportedSSE {
+			b.log(p, "Skipped unsupported message", nil)
+			v.written(p)
+			return nil
+		}
+		if err != nil {
+			b.log(p, "Failed writing to connection", err)
+			return err
+		}
+		flusher.Flush()
+		v.written(p)
+		atomic.AddUint64(&b.totalSent, 1)
+		if idle != nil {
+			p.touch()
+		}
+		pace.wrote()
+		return nil
+	}
+
+	for {
+		select {
+		case <-ping:
+			_, err := io.WriteString(w, ": ping\n\n")
+			if err != nil {
+				b.log(p, "Failed writing ping", err)
+				return err
+			}
+			flusher.Flush()
+		case v := <-pace.out:
+			if err := write(v); err != nil {
+				return err
+			}
+		case <-pace.ready:
+			if v, ok := p.queue.pop(); ok {
+				if err := write(v); err != nil {
+					return err
+				}
+			}
+		case <-pace.resume:
+			pace.unpause()
+		case <-idle:
+			if d := b.idleTimeout - p.idleFor(); d > 0 {
+				idleTimer.Reset(d)
+				continue
+			}
+			b.log(p, "Idle timeout", nil)
+			return ErrIdleTimeout
+		case <-done: // The client closed the connection.
+			b.logLevel(LogDebug, p, "Client closed connection", nil)
+			return nil
+		case <-p.ctx.Done(): // The connection context is done.
+			b.logLevel(LogInfo, p, fmt.Sprintf("Context done: %s", p.ctx.Err()), nil)
+			return p.ctx.Err()
+		case <-p.closing: // The server terminated the connection.
+			b.log(p, p.termination.event, nil)
+			return p.termination.reason
+		}
+	}
+}
+
+// writeInitialEvent writes the initial message of an SSE pear directly to its connection.
+func (b *Beam) writeInitialEvent(p *Client, w io.Writer) error {
+	data, err := b.initialMessage(p)
+	if err != nil {
+		return err
+	}
+	msg, err := b.prepare(data)
+	if err != nil {
+		return err
+	}
+	return writeEvent(w, msg)
+}
+
+// writeEvent writes a message as an SSE event. Every line of the message is written in its own
+// data field, such that the client receives the message as is.
+func writeEvent(w io.Writer, msg *message) error {
+	if msg.messageType != websocket.TextMessage || msg.data == nil {
+		return errUnsupportedSSE
+	}
+	var buf bytes.Buffer
+	for _, line := range bytes.Split(msg.data, []byte("\n")) {
+		buf.WriteString("data: ")
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	buf.WriteByte('\n')
+	_, err := w.Write(buf.Bytes())
+	return err
+}
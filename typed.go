@@ -0,0 +1,26 @@
+package wsbeam
+
+import "context"
+
+// TypedBeam is a beam that its `Send` method accepts only values of type T, to ensure at compile time
+// that all the broadcast messages have the same type. The other methods of the embedded beam are
+// not restricted to T.
+type TypedBeam[T any] struct {
+	*Beam
+}
+
+// NewTyped returns a new TypedBeam with the given options (see `New`).
+func NewTyped[T any](ops ...func(*Beam)) *TypedBeam[T] {
+	return &TypedBeam[T]{Beam: New(ops...)}
+}
+
+// Send the value to all connected connections.
+func (tb *TypedBeam[T]) Send(v T) error {
+	return tb.Beam.Send(v)
+}
+
+// Pump sends every value that is received from the channel to all connected connections, until the
+// channel is closed or the context is done (see `Beam.Pump`).
+func (tb *TypedBeam[T]) Pump(ctx context.Context, ch <-chan T) error {
+	return pump(ctx, ch, tb.Send)
+}
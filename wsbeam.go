@@ -3,26 +3,214 @@
 package wsbeam
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/fnv"
 	"log"
+	"math/rand"
+	"net"
 	"net/http"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
 
 	"github.com/gorilla/websocket"
 )
 
+// closeTimeout is the time given for writing a close message to a connection, and for the client to
+// reply to it.
+const closeTimeout = time.Second
+
+var (
+	// ErrClosed is returned when sending data to a closed beam.
+	ErrClosed = errors.New("beam is closed")
+	// ErrEvicted is the disconnection reason of a client that was replaced by a newer connection
+	// with the same key (see `OptEvictByKey`).
+	ErrEvicted = errors.New("evicted by a newer connection")
+	// ErrDisconnectAll is the disconnection reason of clients that were disconnected by
+	// `DisconnectAll`.
+	ErrDisconnectAll = errors.New("disconnected by the server")
+	// ErrEvictedOldest is the disconnection reason of clients that were disconnected by
+	// `EvictOldest`.
+	ErrEvictedOldest = errors.New("evicted as one of the oldest connections")
+	// ErrIdleTimeout is the disconnection reason of a client that was idle for too long (see
+	// `OptIdleTimeout`).
+	ErrIdleTimeout = errors.New("idle timeout")
+	// ErrReadRateLimit is the disconnection reason of a client that exceeded the read rate limit.
+	ErrReadRateLimit = errors.New("read rate limit exceeded")
+	// ErrDuplicate is returned when a message is not sent because it is identical to the previous
+	// message (see `OptDedupe`).
+	ErrDuplicate = errors.New("duplicate message")
+	// ErrRejected is returned by `Upgrade` when a connection is rejected by one of the options, such
+	// as `OptAuthorize`.
+	ErrRejected = errors.New("connection rejected")
+	// ErrSkip can be returned from the build function of `SendEach` to skip a client.
+	ErrSkip = errors.New("skip client")
+	// ErrMarshal is matched by the errors of sending data that could not be marshaled, either to
+	// JSON or with the encoder (see `OptEncoder` and `MarshalError`).
+	ErrMarshal = errors.New("failed marshaling")
+	// ErrPrepare is matched by the errors of sending data that could not be prepared as a websocket
+	// message, for example, due to an invalid message type (see `PrepareError`).
+	ErrPrepare = errors.New("failed preparing message")
+	// errMaxConnections is used when a new connection exceeds the maximum connections limit. It
+	// wraps `ErrRejected`.
+	errMaxConnections = fmt.Errorf("%w: too many connections", ErrRejected)
+	// errMaxConnectionsPerIP is used when a new connection exceeds the maximum connections limit of
+	// its IP. It wraps `ErrRejected`.
+	errMaxConnectionsPerIP = fmt.Errorf("%w: too many connections from the same IP", ErrRejected)
+	// errPaused is used when sending data to a paused beam.
+	errPaused = errors.New("beam is paused")
+)
+
+// MarshalError is the error of sending data that could not be marshaled, either to JSON or with
+// the encoder (see `OptEncoder`). It matches `ErrMarshal` with `errors.Is`, and unwraps to the
+// marshaling error, such that it can be inspected with `errors.As`.
+type MarshalError struct {
+	// Data is the data that could not be marshaled.
+	Data interface{}
+	// Err is the marshaling error.
+	Err error
+}
+
+func (e *MarshalError) Error() string { return fmt.Sprintf("%s %v: %s", ErrMarshal, e.Data, e.Err) }
+
+// Is reports whether the target is `ErrMarshal`.
+func (e *MarshalError) Is(target error) bool { return target == ErrMarshal }
+
+// Unwrap returns the marshaling error.
+func (e *MarshalError) Unwrap() error { return e.Err }
+
+// PrepareError is the error of sending data that could not be prepared as a websocket message. It
+// matches `ErrPrepare` with `errors.Is`, and unwraps to the underlying error, such that it can be
+// inspected with `errors.As`.
+type PrepareError struct {
+	// Err is the underlying error.
+	Err error
+}
+
+func (e *PrepareError) Error() string { return fmt.Sprintf("%s: %s", ErrPrepare, e.Err) }
+
+// Is reports whether the target is `ErrPrepare`.
+func (e *PrepareError) Is(target error) bool { return target == ErrPrepare }
+
+// Unwrap returns the underlying error.
+func (e *PrepareError) Unwrap() error { return e.Err }
+
+// Sender is the interface for sending data to connections of a beam. It is implemented by `*Beam`,
+// and can be used by code that only sends data, to allow replacing the beam in tests.
+type Sender interface {
+	Send(data interface{}) error
+	SendText(s string) error
+	SendBytes(data []byte, messageType int) error
+	SendContext(ctx context.Context, data interface{}) error
+	SendWait(data interface{}) error
+	SendTo(topic string, data interface{}) error
+	SendFunc(data interface{}, match func(c *Client) bool) error
+}
+
+var _ Sender = (*Beam)(nil)
+
 // Beam is an HTTP handler that can send data to all connected connections.
 type Beam struct {
-	// pears stores all the connected pears. It is protected for concurrent access by the lock
-	// field.
-	pears map[*pear]bool
-	lock  sync.Mutex
+	// count is the number of connected pears. It and the following counters are accessed
+	// atomically, and are the first fields to guarantee their alignment.
+	count int64
+	// totalConnections is the number of pears that were ever added.
+	totalConnections uint64
+	// totalSent is the number of messages that were written to connections.
+	totalSent uint64
+	// totalDropped is the number of messages that were discarded due to full buffers.
+	totalDropped uint64
+	// seq is the sequence number of the last message that was sent to all pears.
+	seq uint64
+	// lastHash is the hash of the last message that was sent to all pears, when dedupe is set.
+	lastHash uint64
+
+	// shards stores all the connected pears. The pears are divided between the shards, each
+	// protected by its own lock, to reduce lock contention when there are many connections.
+	shards []shard
+	// nextShard is used to distribute new pears between the shards. It is accessed atomically.
+	nextShard uint32
+
+	// lock protects the beam state. It is held when adding pears and when closing the beam, such
+	// that no pear is added after the beam was closed.
+	lock sync.RWMutex
+
+	// pending is the number of connections that are being upgraded, and are counted towards the
+	// maximum connections limit. It is protected by the lock field.
+	pending int
+
+	// closed is set when the beam was closed. It is protected by the lock field.
+	closed bool
+	// noCloseHandshake determines whether connections are closed without the closing handshake.
+	noCloseHandshake bool
+
+	// closeCode and closeText are the close message that is sent to connections when the beam is
+	// closed.
+	closeCode int
+	closeText string
+
+	// evictKey computes the key of a connection from its request. A new connection evicts an
+	// existing connection with the same key.
+	evictKey func(*http.Request) string
+	// keys maps connection keys to their pears. It is protected by the lock field.
+	keys map[string]*Client
+	// suspended maps resume tokens to the messages that were not written to disconnected pears. It
+	// is protected by the lock field.
+	suspended map[string]*suspended
+	// resumeTTL is the time that the messages of disconnected pears are kept. If zero, connections
+	// can't be resumed.
+	resumeTTL time.Duration
+
+	// paused is set while broadcasting is paused. It is protected by the lock field.
+	paused bool
+
+	// retained is the last message that was sent to all pears, when retainLast is set. It is
+	// protected by the lock field.
+	retained   *message
+	retainLast bool
+
+	// history holds the last messages that were sent to all pears, for replaying them to new pears.
+	// It is nil if the history is disabled. It is protected by the lock field.
+	history *history
+
+	// maxConnections is the maximum number of concurrent connections. If zero, there is no limit.
+	maxConnections int
+	// maxConnectionsPerIP is the maximum number of concurrent connections from the same IP. If
+	// zero, there is no limit.
+	maxConnectionsPerIP int
+	// trustForwardedFor enables taking the client IP from the X-Forwarded-For header.
+	trustForwardedFor bool
+	// remoteAddr returns the address of a connection from its request.
+	remoteAddr func(*http.Request) string
+	// ips counts the connections of every IP, including reserved connections, when there is a
+	// limit per IP. It is protected by the lock field.
+	ips map[string]int
+	// retryAfter returns the time after which rejected clients should retry to connect.
+	retryAfter func() time.Duration
+
+	// topicKey is the URL query parameter that clients use to subscribe to topics.
+	topicKey string
 
 	// buffer is the number of messages, per connection, that the server stores when client does not
 	// read them, without discarding new messages.
 	buffer int
+	// bufferFunc computes the buffer size of a connection from its request.
+	bufferFunc func(*http.Request) int
+	// dynamicBuffer determines whether connection buffers grow between bufferMin and bufferMax,
+	// instead of having a fixed size.
+	dynamicBuffer bool
+	bufferMin     int
+	bufferMax     int
 
 	// upgrader is the websocket upgarder.
 	upgrader websocket.Upgrader
@@ -30,19 +218,143 @@ type Beam struct {
 	// headers that the server returns for connected clients.
 	headers http.Header
 
+	// encoder encodes data that is sent to the connections. If nil, data is marshaled to JSON.
+	encoder func(interface{}) ([]byte, int, error)
+
+	// gzipPayload enables compressing the encoded messages with gzip.
+	gzipPayload bool
+
+	// sequence enables wrapping messages with sequence numbers.
+	sequence bool
+	// dedupe enables skipping messages that are identical to the previous message.
+	dedupe bool
+
+	// messageType is the websocket message type of JSON messages.
+	messageType int
+
+	// allowedOrigins are the origins that are allowed to connect. If empty, the upgrader origin
+	// check is used.
+	allowedOrigins []string
+
+	// handshakeTimeout is the timeout for completing the websocket handshake.
+	handshakeTimeout time.Duration
+
+	// subprotocols are the supported subprotocols, in order of preference.
+	subprotocols []string
+
+	// compression enables compression of messages with the given compressionLevel.
+	compression      bool
+	compressionLevel int
+	// compressionThreshold is the minimal size of messages that are compressed.
+	compressionThreshold int
+
 	// logger is the logging function. if nil, no log will be written.
 	logger func(string, ...interface{})
+	// structuredLogger is the structured logging function. If not nil, it is used instead of
+	// logger.
+	structuredLogger func(level, msg string, fields map[string]interface{})
+	// minLogLevel is the minimal level of the logged events.
+	minLogLevel LogLevel
+
+	// pingInterval is the interval between pings sent to the clients. If zero, no pings are sent.
+	pingInterval time.Duration
+
+	// writeTimeout is the deadline for writing a message to a connection. If zero, there is no
+	// deadline.
+	writeTimeout time.Duration
+	// overflowPolicy is the policy for sending messages to pears with full buffers.
+	overflowPolicy OverflowPolicy
+	// bufferLimit limits the total size of the buffered messages. It is nil if there is no limit.
+	bufferLimit *bufferLimit
+	// sendWorkers is the number of goroutines that enqueue a message to the pears. If it is not
+	// greater than one, the pears are iterated by the sending goroutine.
+	sendWorkers int
+
+	// disconnectDetection is the method for detecting that clients disconnected.
+	disconnectDetection DisconnectDetection
+
+	// baseContext returns the context of a new connection. When the context is done, the connection
+	// is closed.
+	baseContext func(r *http.Request) context.Context
+
+	// idleTimeout is the time after which connections without activity are closed. If zero, idle
+	// connections are not closed.
+	idleTimeout time.Duration
+
+	// authorize authorizes a new connection from its HTTP request.
+	authorize func(*http.Request) error
+	// tags returns the tags of a new connection from its HTTP request.
+	tags func(*http.Request) []string
+	// sampleSeeded determines whether the connections that sampled messages are sent to are
+	// selected by the sampleSeed, instead of randomly.
+	sampleSeeded bool
+	sampleSeed   uint64
+
+	// connectMetadata returns the metadata of a new connection from its HTTP request.
+	connectMetadata func(*http.Request) (map[string]interface{}, error)
+
+	// onMessage is called for every message that is received from a connection.
+	onMessage func(*Client, int, []byte)
+	// onRequest is called for every message that is received from a connection, and returns a
+	// reply to the connection.
+	onRequest func(*Client, int, []byte) (interface{}, error)
+
+	// initialMessage returns the first message that is sent to a new connection.
+	initialMessage func(*Client) (interface{}, error)
+
+	// onDrop is called for every connection that a message was discarded for.
+	onDrop func(*Client, interface{})
+	// onRecover is called when the buffer of a connection drains after it was full.
+	onRecover func(*Client)
+
+	// readLimit is the maximum size in bytes of a message that is read from a connection. If zero,
+	// there is no limit.
+	readLimit int64
+
+	// readRate is the maximum number of messages per second that are read from a connection. If
+	// zero, the rate is not limited.
+	readRate int
+	// readRateDisconnect determines whether connections that exceed the read rate are
+	// disconnected, instead of having their messages discarded.
+	readRateDisconnect bool
+	// sendRate is the maximum number of messages per second that are written to a connection. If
+	// zero, the rate is not limited.
+	sendRate int
+
+	// onConnect is called for every new connection.
+	onConnect func(*Client)
+	// onDisconnect is called for every connection that was disconnected.
+	onDisconnect func(*Client, error)
+	// onError is called for every error that is logged.
+	onError func(*Client, error)
 }
 
 // New returns a new Beam with the given options. This beam should be mounted as an HTTP handler.
 // Clients can connect with websocket connection to this handler. All data that is sent to the
-// `Send` method will be sent to all connected connections.
+// `Send` method will be sent to all connected connections. New panics if the options are invalid,
+// use `NewE` to get an error instead.
 func New(ops ...func(*Beam)) *Beam {
+	b, err := NewE(ops...)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// NewE returns a new Beam with the given options, as `New` does. It returns an error if the options
+// are invalid, for example, an invalid message type (see `OptMessageType`).
+func NewE(ops ...func(*Beam)) (*Beam, error) {
 	// Default values:
 	b := &Beam{
-		pears:  map[*pear]bool{},
-		buffer: 100,
-		logger: log.Printf,
+		shards:      newShards(shardCount),
+		keys:        map[string]*Client{},
+		ips:         map[string]int{},
+		suspended:   map[string]*suspended{},
+		buffer:      100,
+		topicKey:    "topic",
+		logger:      log.Printf,
+		messageType: websocket.TextMessage,
+		closeCode:   websocket.CloseGoingAway,
 	}
 
 	// Apply options over default values.
@@ -50,7 +362,25 @@ func New(ops ...func(*Beam)) *Beam {
 		o(b)
 	}
 
-	return b
+	if b.messageType != websocket.TextMessage && b.messageType != websocket.BinaryMessage {
+		return nil, fmt.Errorf("invalid message type %d", b.messageType)
+	}
+
+	// Apply options that modify the upgrader, regardless of the options order.
+	if b.compression {
+		b.upgrader.EnableCompression = true
+	}
+	if len(b.allowedOrigins) > 0 {
+		b.upgrader.CheckOrigin = b.checkOrigin
+	}
+	if len(b.subprotocols) > 0 {
+		b.upgrader.Subprotocols = b.subprotocols
+	}
+	if b.handshakeTimeout > 0 {
+		b.upgrader.HandshakeTimeout = b.handshakeTimeout
+	}
+
+	return b, nil
 }
 
 // OptBuffer sets the message buffer size - number of messages that the server can keep for each
@@ -60,130 +390,2198 @@ func OptBuffer(buffer int) func(*Beam) {
 	return func(b *Beam) { b.buffer = buffer }
 }
 
+// OptBufferFunc sets a function that computes the message buffer size of a connection from its
+// request, for example, from a query parameter or a header. If the function returns a negative
+// value, the buffer size of `OptBuffer` is used.
+func OptBufferFunc(bufferFunc func(r *http.Request) int) func(*Beam) {
+	return func(b *Beam) { b.bufferFunc = bufferFunc }
+}
+
+// OptDynamicBuffer sets a growable message buffer for each connection, instead of a fixed one. The
+// buffer of a connection starts with the min size, and when it is full, it grows up to the max size
+// before messages are discarded. It shrinks back when the connection catches up. This allows slow
+// connections to handle bursts of messages, without keeping large buffers for all the connections.
+// It overrides `OptBuffer` and `OptBufferFunc`.
+func OptDynamicBuffer(min, max int) func(*Beam) {
+	return func(b *Beam) {
+		b.dynamicBuffer = true
+		b.bufferMin = min
+		b.bufferMax = max
+	}
+}
+
+// OptGzipPayload compresses every message that is encoded by the beam with gzip, and sends it as a
+// binary message, for clients that can't use websocket compression (see `OptCompression`), for
+// example, due to proxies that don't support it. Clients should decompress the binary messages to
+// get the encoded data. The messages start with the gzip magic bytes 0x1f 0x8b, which clients can
+// use to detect compression, since JSON messages can't start with these bytes. Raw messages that
+// are sent with `SendText`, `SendBytes` and `SendPrepared` are not compressed. Since SSE supports
+// only text, the compressed messages are not sent to SSE connections.
+func OptGzipPayload() func(*Beam) {
+	return func(b *Beam) { b.gzipPayload = true }
+}
+
+// OptSequence wraps every message that is encoded by the beam with an envelope of the form
+// `{"seq": N, "data": <data>}`. Messages that are sent to all the connections, such as with `Send`,
+// get increasing sequence numbers, starting from 1, such that clients can detect missed messages by
+// gaps in the sequence. Messages that are sent only to some of the connections, such as with
+// `SendTo`, `Client.Send` and the initial message, have a zero sequence number, and should be
+// ignored for gap detection. The sequence number is assigned when the message is prepared, so
+// messages that are sent concurrently may be received in a different order than their sequence
+// numbers. Raw messages that are sent with `SendText`, `SendBytes` and `SendPrepared` are not
+// wrapped.
+func OptSequence() func(*Beam) {
+	return func(b *Beam) { b.sequence = true }
+}
+
+// OptDedupe makes the beam skip messages that are sent to all the connections, such as with `Send`,
+// and are identical to the previous such message. The messages are compared by a hash of their
+// encoded data, without their sequence number (see `OptSequence`). A skipped message is not sent to
+// any connection, and the send method returns `ErrDuplicate`. `SendMany` skips only the duplicate
+// items, and returns `ErrDuplicate` only if all the items were skipped. Raw messages that are sent
+// with `SendText`, `SendBytes` and `SendPrepared` are not compared. Messages that are not sent
+// since the beam is paused or closed are not considered as the previous message.
+func OptDedupe() func(*Beam) {
+	return func(b *Beam) { b.dedupe = true }
+}
+
+// OptHistory makes the beam keep the last n messages that were sent to all the connections. New
+// connections that request a replay, with the "replay=1" URL query parameter, receive these
+// messages, from the oldest to the newest, before any other message. When `OptRetainLast` is also
+// used, such connections receive the history instead of the retained message. Messages that are
+// sent only to some of the connections, such as with `SendTo`, are not kept. The history is
+// replayed into the connection buffer, so messages that don't fit in it are discarded. The kept
+// messages are prepared messages that are shared with the connections, so the memory of the
+// history is bounded by n messages.
+func OptHistory(n int) func(*Beam) {
+	return func(b *Beam) {
+		if n > 0 {
+			b.history = newHistory(n)
+		}
+	}
+}
+
+// OptMaxConnections sets the maximum number of concurrent connections. When the limit is reached, new
+// connections are closed with code 1013 (try again later) right after the websocket handshake, and
+// new SSE connections are rejected with HTTP 503 status. The default is no limit.
+func OptMaxConnections(n int) func(*Beam) {
+	return func(b *Beam) { b.maxConnections = n }
+}
+
+// OptTopicKey sets the URL query parameter that clients use to subscribe to topics. The default is
+// "topic". See `SendTo`.
+func OptTopicKey(key string) func(*Beam) {
+	return func(b *Beam) { b.topicKey = key }
+}
+
+// OptRetainLast makes the beam retain the last message that was sent to all the connections, and
+// send it to every new connection once it is connected. Messages that are sent only to some of the
+// connections, such as with `SendTo`, are not retained.
+func OptRetainLast() func(*Beam) {
+	return func(b *Beam) { b.retainLast = true }
+}
+
 // OptUpgrader sets the websocket upgrader configuration that is used to upgrade incoming
 // connections.
 func OptUpgrader(upgrader websocket.Upgrader) func(*Beam) {
 	return func(b *Beam) { b.upgrader = upgrader }
 }
 
+// OptResumable enables resuming connections. When a connection is disconnected, the messages that
+// were buffered for it and were not yet written are kept for the given time, under a token that is
+// returned to the client in the `ResumeHeader` header of the connection response, and by
+// `Client.ResumeToken`. A client that connects with the token in the "resume" URL query parameter,
+// for example "/ws?resume=<token>", gets these messages before any other message. Every connection
+// gets a new token, and a token can be used only once. Browsers can't read the headers of websocket
+// responses, so browser clients should get the token in a message, for example, with
+// `OptInitialMessage`. The kept messages are not counted by `OptMaxBufferedBytes`. Messages that are
+// sent while the client is disconnected are not kept, and can be replayed with `OptHistory`.
+func OptResumable(ttl time.Duration) func(*Beam) {
+	return func(b *Beam) { b.resumeTTL = ttl }
+}
+
 // OptHeaders set the headers for the HTTP response of a websocket connection.
 func OptHeaders(headers http.Header) func(*Beam) {
 	return func(b *Beam) { b.headers = headers }
 }
 
+// OptEncoder sets the function that is used to encode the data that is sent to the connections,
+// instead of marshaling it to JSON. The function returns the encoded data and the websocket message
+// type, which should be either `websocket.TextMessage` or `websocket.BinaryMessage`. It can be
+// used, for example, to send MessagePack or Protobuf encoded messages.
+func OptEncoder(encoder func(v interface{}) ([]byte, int, error)) func(*Beam) {
+	return func(b *Beam) { b.encoder = encoder }
+}
+
+// OptMessageType sets the websocket message type of the JSON messages that are sent to the
+// connections. It should be either `websocket.TextMessage` (the default) or
+// `websocket.BinaryMessage`, otherwise `NewE` returns an error, and `New` panics. It does not apply
+// to messages that are encoded with a custom encoder, or sent with `SendText` and `SendBytes`.
+func OptMessageType(messageType int) func(*Beam) {
+	return func(b *Beam) { b.messageType = messageType }
+}
+
+// OptAllowedOrigins sets the origins that are allowed to connect to the beam. The origins should be
+// in the form of "https://example.com", and the "*" origin allows any origin. Requests with other
+// origins are rejected with HTTP 403 status. Requests without an origin header are always allowed.
+// This option overrides the `CheckOrigin` function of the upgrader.
+func OptAllowedOrigins(origins ...string) func(*Beam) {
+	return func(b *Beam) { b.allowedOrigins = origins }
+}
+
+// OptMaxConnectionsPerIP sets the maximum number of concurrent connections from the same client IP.
+// When the limit is reached, new connections from that IP are rejected with HTTP 429 status. The IP
+// is taken from the remote address of the request, or, with `OptTrustForwardedFor`, from the
+// X-Forwarded-For header. The default is no limit.
+func OptMaxConnectionsPerIP(n int) func(*Beam) {
+	return func(b *Beam) { b.maxConnectionsPerIP = n }
+}
+
+// OptTrustForwardedFor makes the beam take the client IP of a connection from the X-Forwarded-For
+// header, when it is present (see `OptMaxConnectionsPerIP`). The last address in the header is
+// used, which is the address that the proxy in front of the server added. It should be used only
+// when the server is behind a trusted proxy that sets this header, since otherwise clients can
+// forge it.
+func OptTrustForwardedFor() func(*Beam) {
+	return func(b *Beam) { b.trustForwardedFor = true }
+}
+
+// OptRemoteAddr sets a function that returns the address of a connection from its request, for
+// example, from a header that a proxy in front of the server sets. The address is the one that is
+// logged, returned by `Clients` and `Client.Addr`, and matched by `SendToAddr`. The default is the
+// remote address of the request.
+func OptRemoteAddr(remoteAddr func(r *http.Request) string) func(*Beam) {
+	return func(b *Beam) { b.remoteAddr = remoteAddr }
+}
+
+// OptRetryAfter sets a function that returns the time after which a rejected client should retry
+// to connect. When the beam rejects a connection with HTTP 429 or 503 status, because it has too
+// many connections (see `OptMaxConnections` and `OptMaxConnectionsPerIP`) or because it is closed,
+// the response includes a Retry-After header with this time, rounded up to whole seconds. Websocket
+// connections that exceed `OptMaxConnections` are closed after the handshake instead, and their
+// close reason ends with ", retry after <seconds>s". Returning a different, jittered, time for
+// every call spreads the reconnections of the rejected clients.
+func OptRetryAfter(retryAfter func() time.Duration) func(*Beam) {
+	return func(b *Beam) { b.retryAfter = retryAfter }
+}
+
+// OptHandshakeTimeout sets the timeout for completing the websocket handshake, such that a slow
+// client can't hold the connection handler during the upgrade. It is recommended to set it, as well
+// as the read timeouts of the HTTP server, since by default there is no timeout. This option
+// overrides the `HandshakeTimeout` of the upgrader.
+func OptHandshakeTimeout(d time.Duration) func(*Beam) {
+	return func(b *Beam) { b.handshakeTimeout = d }
+}
+
+// OptSubprotocols sets the subprotocols that the server supports, in order of preference. The
+// server selects the first of them that the client requested, and the selected subprotocol is
+// available with `Client.Subprotocol`. Clients that did not request any of them are still
+// connected, without a subprotocol. This option overrides the `Subprotocols` of the upgrader.
+func OptSubprotocols(protos ...string) func(*Beam) {
+	return func(b *Beam) { b.subprotocols = protos }
+}
+
+// OptCompression enables per message compression (permessage-deflate) with the given compression
+// level (see `compress/flate` for valid levels). Compression is used only for clients that
+// support it. Since each message is prepared once for all the connections, it is also compressed
+// only once for all the connections that use compression.
+func OptCompression(level int) func(*Beam) {
+	return func(b *Beam) {
+		b.compression = true
+		b.compressionLevel = level
+	}
+}
+
+// OptCompressionThreshold sets the minimal size, in bytes, of messages that are compressed when
+// compression is enabled (see `OptCompression`). Smaller messages are sent uncompressed, since
+// compressing them wastes CPU and may even increase their size. Messages that are sent with
+// `SendPrepared` are always compressed, since their size is not known. The default is zero, which
+// means that all the messages are compressed.
+func OptCompressionThreshold(bytes int) func(*Beam) {
+	return func(b *Beam) { b.compressionThreshold = bytes }
+}
+
 // OptLogger sets the logger function. The default is standard go log, use `nil` to disable logging.
+// Every message is prefixed with its level, for example "info" (see `LogLevel`).
 func OptLogger(logger func(string, ...interface{})) func(*Beam) {
 	return func(b *Beam) { b.logger = logger }
 }
 
-type pear struct {
-	ch   chan<- *websocket.PreparedMessage
-	addr string
+// OptLogLevel sets the minimal level of the events that are logged, for both the logger of
+// `OptLogger` and the logger of `OptStructuredLogger`. Errors are reported to the function of
+// `OptOnError` regardless of the level. The default is `LogDebug`, which logs all the events.
+func OptLogLevel(level LogLevel) func(*Beam) {
+	return func(b *Beam) { b.minLogLevel = level }
 }
 
-func (b *Beam) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	ch := make(chan *websocket.PreparedMessage, b.buffer)
-	p := &pear{
-		addr: r.RemoteAddr,
-		ch:   ch,
+// OptStructuredLogger sets a structured logger function, which is used instead of the logger of
+// `OptLogger`. The level is "debug", "info", "warn" or "error" (see `LogLevel`). The fields of
+// connection events include the remote address of the connection under "addr", and the error, if
+// any, under "error". The fields of discarded messages include the remote addresses of the
+// connections under "addrs".
+func OptStructuredLogger(logger func(level, msg string, fields map[string]interface{})) func(*Beam) {
+	return func(b *Beam) { b.structuredLogger = logger }
+}
+
+// DisconnectDetection is a method for detecting that clients disconnected (see
+// `OptDisconnectDetection`).
+type DisconnectDetection int
+
+const (
+	// DetectReadLoop detects disconnections by reading from each connection in a dedicated
+	// goroutine. Clean closes and network errors are detected immediately, and when pings are sent,
+	// clients that don't reply with pongs in time are disconnected. This is the default, and it is
+	// the only mode in which client messages are read (see `OptOnMessage`, `OptReadLimit` and
+	// `OptReadRateLimit`).
+	DetectReadLoop DisconnectDetection = iota
+	// DetectPingOnly detects disconnections only by failures to write pings (see `OptPingInterval`)
+	// and messages, without a reading goroutine. It saves a goroutine per connection, but
+	// disconnections are detected only after the next failed write, and pongs are not verified.
+	// Since nothing reads from the connections, client messages are discarded by the network
+	// buffers, and clients that keep sending messages may block.
+	DetectPingOnly
+	// DetectNone does not read from the connections and does not send pings, even if
+	// `OptPingInterval` is set. Disconnections are detected only by failures to write messages, so
+	// disconnected clients of a beam that rarely sends messages may stay in the beam for a long
+	// time. It has the lowest overhead per connection.
+	DetectNone
+)
+
+// LogLevel is the severity of a logged event (see `OptLogLevel`).
+type LogLevel int
+
+const (
+	// LogDebug is the level of connection lifecycle events, such as new connections and
+	// disconnections.
+	LogDebug LogLevel = iota
+	// LogInfo is the level of notable events, such as idle timeouts and connections that were
+	// closed by the server.
+	LogInfo
+	// LogWarn is the level of events that may indicate a problem, such as discarded messages.
+	LogWarn
+	// LogError is the level of failures, such as errors writing to connections.
+	LogError
+)
+
+// String returns the name of the level, as it is given to the structured logger (see
+// `OptStructuredLogger`).
+func (l LogLevel) String() string {
+	switch l {
+	case LogDebug:
+		return "debug"
+	case LogInfo:
+		return "info"
+	case LogWarn:
+		return "warn"
+	case LogError:
+		return "error"
 	}
-	b.log(p, "New connection")
+	return strconv.Itoa(int(l))
+}
 
-	b.add(p)
-	defer b.remove(p)
+// OverflowPolicy is the policy for sending a message to a client which its buffer is full (see
+// `OptOverflowPolicy`).
+type OverflowPolicy int
 
-	// Create a websocket connection with the client.
-	conn, err := b.upgrader.Upgrade(w, r, b.headers)
+const (
+	// DropNewest discards the new message, and keeps the messages that are already in the buffer.
+	// This is the default.
+	DropNewest OverflowPolicy = iota
+	// DropOldest discards the oldest message in the buffer, and adds the new message to it, such
+	// that slow clients get the freshest messages.
+	DropOldest
+)
+
+// OptOverflowPolicy sets the policy for sending a message to a client which its buffer is full. In
+// both policies, the discarded message is counted as dropped, and is reported with the data of the
+// new message (see `OptOnDrop`), since the data of the oldest message is no longer available. The
+// oldest message is discarded while the buffer is locked, so it is either written to the client
+// before it is discarded, or not at all, and the order of the messages is kept. With `DropOldest`,
+// the new message is reported as delivered by `SendReport` and `SendDetailed`, and `SendSync` stops
+// waiting for a message that was discarded. `SendWait` is not affected by the policy, and never
+// discards messages. The default is `DropNewest`.
+func OptOverflowPolicy(policy OverflowPolicy) func(*Beam) {
+	return func(b *Beam) { b.overflowPolicy = policy }
+}
+
+// OptMaxBufferedBytes sets the maximum total size, in bytes, of the messages that are buffered for
+// all the connections and were not yet written to them, to cap the memory of the beam when clients
+// are slow. A message is counted once for every connection that it is buffered for. A message that
+// would exceed the maximum is discarded, as if the buffer of the client was full, regardless of the
+// overflow policy (see `OptOverflowPolicy`). `SendWait` is not limited, but the messages that it
+// buffers are counted. The default is no limit.
+func OptMaxBufferedBytes(n int64) func(*Beam) {
+	return func(b *Beam) {
+		b.bufferLimit = nil
+		if n > 0 {
+			b.bufferLimit = &bufferLimit{max: n}
+		}
+	}
+}
+
+// OptParallelSend sets the number of goroutines that enqueue every message that is sent to the
+// connections. The connections are divided between the goroutines, such that `SendWait` is not
+// delayed by connections with full buffers beyond the slowest connection in each group, and sends
+// to many connections use more than one CPU. The number of goroutines is at most the number of
+// internal shards of the connections. The order of the messages of every connection is kept. The
+// default is to enqueue the messages from the sending goroutine.
+func OptParallelSend(workers int) func(*Beam) {
+	return func(b *Beam) { b.sendWorkers = workers }
+}
+
+// OptDisconnectDetection sets the method for detecting that clients disconnected. The default is
+// `DetectReadLoop`.
+func OptDisconnectDetection(mode DisconnectDetection) func(*Beam) {
+	return func(b *Beam) { b.disconnectDetection = mode }
+}
+
+// OptPingInterval sets an interval for sending ping messages to the connected clients. Clients that
+// do not respond with a pong message within twice the interval are disconnected. This allows
+// detecting dead connections that would not be detected otherwise. The default is not to send
+// pings.
+func OptPingInterval(interval time.Duration) func(*Beam) {
+	return func(b *Beam) { b.pingInterval = interval }
+}
+
+// OptBaseContext sets a function that returns the context of each new connection, for example, to
+// tie the connections to the application lifecycle. When the context is done, the connection is
+// closed, and the context error is the disconnection reason.
+func OptBaseContext(baseContext func(r *http.Request) context.Context) func(*Beam) {
+	return func(b *Beam) { b.baseContext = baseContext }
+}
+
+// OptIdleTimeout sets a timeout for connections that are idle: connections that no message was
+// written to or read from them for the given duration are closed, with `ErrIdleTimeout` as the
+// disconnection reason. Pings and pongs are not considered as activity. Connections that receive
+// broadcasts are kept alive. The default is zero, which means that idle connections are not closed.
+func OptIdleTimeout(timeout time.Duration) func(*Beam) {
+	return func(b *Beam) { b.idleTimeout = timeout }
+}
+
+// OptWriteTimeout sets a timeout for writing a message to a connection. Connections that the
+// server fails to write to in time, are disconnected. The default is no timeout.
+func OptWriteTimeout(timeout time.Duration) func(*Beam) {
+	return func(b *Beam) { b.writeTimeout = timeout }
+}
+
+// OptAuthorize sets a function that authorizes every new connection, given its HTTP request, before
+// any other handling of the connection. If the function returns an error, the connection is
+// rejected with HTTP 401 status, or, if the error has a `StatusCode() int` method, with the status
+// that it returns.
+func OptAuthorize(authorize func(r *http.Request) error) func(*Beam) {
+	return func(b *Beam) { b.authorize = authorize }
+}
+
+// OptSampleSeed makes the selection of the connections that `SendSample` sends to deterministic:
+// a connection is selected by its address and the seed, such that the same connections are
+// selected for the same fraction in every call, and a connection that is selected for a fraction is
+// also selected for any larger fraction. This allows reproducible tests, and gradual rollouts to a
+// stable group of clients.
+func OptSampleSeed(seed int64) func(*Beam) {
+	return func(b *Beam) {
+		b.sampleSeeded = true
+		b.sampleSeed = uint64(seed)
+	}
+}
+
+// OptTags sets a function that returns the tags of every new connection, given its HTTP request.
+// Unlike topics, tags are assigned by the server, and a connection can have any number of them. The
+// tags are available from the client handle (see `Client.Tags`). See `SendToTag`.
+func OptTags(tags func(r *http.Request) []string) func(*Beam) {
+	return func(b *Beam) { b.tags = tags }
+}
+
+// OptConnectMetadata sets a function that returns metadata for every new connection, given its HTTP
+// request. The metadata is available from the client handle (see `Client.Metadata`). If the
+// function returns an error, the connection is rejected with HTTP 401 status. It can be used, for
+// example, to authenticate a client and associate a user ID with its connection.
+func OptConnectMetadata(connectMetadata func(r *http.Request) (map[string]interface{}, error)) func(*Beam) {
+	return func(b *Beam) { b.connectMetadata = connectMetadata }
+}
+
+// OptOnMessage sets a function that is called for every message that is received from a client.
+// Messages of a single client are handled sequentially in a goroutine dedicated for reading from the
+// connection. When not set, messages from clients are discarded.
+func OptOnMessage(onMessage func(c *Client, messageType int, data []byte)) func(*Beam) {
+	return func(b *Beam) { b.onMessage = onMessage }
+}
+
+// OptOnRequest sets a function that is called for every message that is received from a client,
+// and returns a reply to that client, for handling requests of clients. A non-nil reply is sent only
+// to the client, as with `Client.Send`. If the function returns an error, or the reply can't be
+// sent, for example, since it can't be marshaled or the client buffer is full, the error is logged
+// (see `OptOnError`), and the client is not disconnected. Messages of a single client are handled
+// sequentially, as with `OptOnMessage`, after the function of `OptOnMessage`, if it is set.
+func OptOnRequest(onRequest func(c *Client, messageType int, data []byte) (reply interface{}, err error)) func(*Beam) {
+	return func(b *Beam) { b.onRequest = onRequest }
+}
+
+// OptInitialMessage sets a function that returns the first message that is sent to every new
+// connection. Unlike `OptRetainLast`, the message is computed for each connection, and can be used,
+// for example, to send a snapshot of the current state to a client. The message is written to the
+// connection before any other message. If the function returns an error, the connection is closed.
+func OptInitialMessage(initialMessage func(c *Client) (interface{}, error)) func(*Beam) {
+	return func(b *Beam) { b.initialMessage = initialMessage }
+}
+
+// OptOnDrop sets a function that is called for every connection that a message was discarded for,
+// due to a full buffer. The data is the value that was sent. When set, discarded messages are not
+// logged.
+func OptOnDrop(onDrop func(c *Client, data interface{})) func(*Beam) {
+	return func(b *Beam) { b.onDrop = onDrop }
+}
+
+// OptOnRecover sets a function that is called when the buffer of a connection, after it was full,
+// drains back to half of its size (see `OptBuffer`), for example, to resume sending to a client
+// that its messages were throttled since `OptOnDrop` was called for it. It is called once for every
+// time that the buffer was full, from the goroutine that writes to the connection, and should not
+// block.
+func OptOnRecover(onRecover func(c *Client)) func(*Beam) {
+	return func(b *Beam) { b.onRecover = onRecover }
+}
+
+// OptReadLimit sets the maximum size in bytes of a message that can be read from a client. Clients
+// that send larger messages are disconnected. The default is zero, which means no limit. It is
+// recommended to set a limit when reading messages from clients with `OptOnMessage`.
+func OptReadLimit(limit int64) func(*Beam) {
+	return func(b *Beam) { b.readLimit = limit }
+}
+
+// OptEvictByKey sets a function that computes a key for every new connection from its request, for
+// example, a user ID. When a new connection has the same key as an existing connection, the
+// existing connection is closed with code 1008 (policy violation) and removed from the beam, before
+// the new connection is added. Its disconnection reason is `ErrEvicted`. Connections with an empty
+// key are never evicted.
+func OptEvictByKey(evictKey func(r *http.Request) string) func(*Beam) {
+	return func(b *Beam) { b.evictKey = evictKey }
+}
+
+// OptNoCloseHandshake disables the closing handshake. By default, when the server disconnects a
+// connection, it sends a close message to the client, and waits for the client to reply with a
+// close message before closing the connection. When this option is used, these connections are
+// closed immediately, without sending a close message.
+func OptNoCloseHandshake() func(*Beam) {
+	return func(b *Beam) { b.noCloseHandshake = true }
+}
+
+// OptCloseMessage sets the code and text of the close message that is sent to connections when the
+// beam is closed with `Close` or `Shutdown`, and to new connections after the beam was closed. The
+// default is code 1001 (going away) without text.
+func OptCloseMessage(code int, text string) func(*Beam) {
+	return func(b *Beam) {
+		b.closeCode = code
+		b.closeText = text
+	}
+}
+
+// OptSendRateLimit limits the number of messages per second that are written to each connection,
+// and paces them evenly, without bursts. Messages that are sent faster are kept in the connection
+// buffer until they can be written, and are discarded when it is full, according to the overflow
+// policy (see `OptOverflowPolicy`). It protects slow clients from fast producers. The default is no
+// limit.
+func OptSendRateLimit(msgsPerSec int) func(*Beam) {
+	return func(b *Beam) { b.sendRate = msgsPerSec }
+}
+
+// OptReadRateLimit limits the number of messages per second that are read from each client, with a
+// burst of up to one second worth of messages. Messages that exceed the limit are discarded, or, if
+// disconnect is true, the client is disconnected with `ErrReadRateLimit` as the reason. It protects
+// the server from clients that flood it with messages when using `OptOnMessage`.
+func OptReadRateLimit(msgsPerSec int, disconnect bool) func(*Beam) {
+	return func(b *Beam) {
+		b.readRate = msgsPerSec
+		b.readRateDisconnect = disconnect
+	}
+}
+
+// OptOnConnect sets a function that is called for every new connection, after the websocket was
+// established. The function is called in the connection serving goroutine, it can be used, for
+// example, to send a welcome message to the client.
+func OptOnConnect(onConnect func(c *Client)) func(*Beam) {
+	return func(b *Beam) { b.onConnect = onConnect }
+}
+
+// OptOnDisconnect sets a function that is called when a connection is disconnected, after it was
+// removed from the beam. The reason is nil if the client closed the connection, `ErrClosed` if the
+// beam was closed, or the error that caused the disconnection otherwise.
+func OptOnDisconnect(onDisconnect func(c *Client, reason error)) func(*Beam) {
+	return func(b *Beam) { b.onDisconnect = onDisconnect }
+}
+
+// OptOnError sets a function that is called for every error of a connection that the beam logs,
+// such as failed upgrades, failed writes and rejected connections, regardless of the logger. The
+// client may be one that was rejected and was never connected. The function is called from the
+// goroutine that serves the connection, and should not block.
+func OptOnError(onError func(c *Client, err error)) func(*Beam) {
+	return func(b *Beam) { b.onError = onError }
+}
+
+func (b *Beam) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p, err := b.Upgrade(w, r)
 	if err != nil {
-		b.log(p, "Failed creating websocket: %s", err)
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
+	p.Serve()
+}
 
-	done := clientClosed(conn)
+// Upgrade upgrades a connection request to a websocket connection, and adds it to the beam, as
+// `ServeHTTP` does, but without serving it. It can be used for integrating the beam in a custom
+// handler. The caller should call either `Client.Serve` or `Client.Close` for the returned client,
+// since the buffered messages are not written to the connection until it is served. If the
+// connection is rejected, the client was already replied to, and the returned error is the
+// rejection reason. Connections that are rejected by one of the options or by the connection limits
+// return an error that wraps `ErrRejected`, which can be checked with `errors.Is`, and includes the
+// error of the rejecting option function, such as the one of `OptAuthorize`.
+func (b *Beam) Upgrade(w http.ResponseWriter, r *http.Request) (*Client, error) {
+	p, err := b.accept(w, r)
+	if err != nil {
+		return nil, err
+	}
 
-	defer conn.Close()
-	defer b.log(p, "Disconnected")
+	// Reserve a place for the connection before it is upgraded, such that a rejected connection
+	// does not take the place of a connected one.
+	if err := b.reserve(p); err != nil {
+		b.log(p, "Rejected connection", err)
+		switch err {
+		case errMaxConnections:
+			b.reject(w, r, p, err)
+		case errMaxConnectionsPerIP:
+			b.setRetryAfter(w.Header())
+			http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		default:
+			b.setRetryAfter(w.Header())
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		}
+		return nil, err
+	}
 
-	// Keep writing to the connection until it is closed.
-	for {
-		select {
-		case v := <-ch:
-			err := conn.WritePreparedMessage(v)
-			if err != nil {
-				b.log(p, "Failed writing to connection: %s", err)
-				return
-			}
-		case <-done: // Wait for client to close the connection.
-			b.log(p, "Client closed connection")
-			return
+	// Create a websocket connection with the client.
+	h := b.headers
+	if p.resumeToken != "" {
+		h = h.Clone()
+		if h == nil {
+			h = http.Header{}
+		}
+		h.Set(ResumeHeader, p.resumeToken)
+	}
+	conn, err := b.upgrader.Upgrade(w, r, h)
+	if err != nil {
+		b.release(p)
+		// The upgrader already replied to the client with the appropriate error.
+		b.log(p, "Failed creating websocket", err)
+		return nil, err
+	}
+	p.conn = conn
+	p.compressed = b.upgrader.EnableCompression && offersDeflate(r.Header)
+	b.logLevel(LogDebug, p, fmt.Sprintf("Upgraded connection: subprotocol %q, compression %t", conn.Subprotocol(), p.compressed), nil)
+
+	// Add the pear only after the connection was upgraded.
+	if err := b.add(p); err != nil {
+		// The beam was closed while the connection was upgraded.
+		b.log(p, "Rejected connection", err)
+		b.closeHandshake(p, conn, nil, b.closeCode, b.closeText)
+		conn.Close()
+		return nil, err
+	}
+
+	if b.compression {
+		if err := conn.SetCompressionLevel(b.compressionLevel); err != nil {
+			b.log(p, "Failed setting compression level", err)
 		}
 	}
+
+	if b.disconnectDetection == DetectReadLoop {
+		p.reads = b.clientClosed(p, conn)
+	}
+	return p, nil
 }
 
-// Send the data to all connected connections.
-func (b *Beam) Send(data interface{}) error {
-	buf, err := json.Marshal(data)
-	if err != nil {
-		return fmt.Errorf("failed marshaling %v: %s", data, err)
+// accept creates a pear for a new connection request. If the connection is rejected, it replies
+// with an HTTP error and returns the rejection reason, wrapped with `ErrRejected`.
+func (b *Beam) accept(w http.ResponseWriter, r *http.Request) (*Client, error) {
+	p := &Client{
+		beam:    b,
+		addr:    r.RemoteAddr,
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
+		ctx:     context.Background(),
 	}
 
-	msg, err := websocket.NewPreparedMessage(1, buf)
-	if err != nil {
-		return fmt.Errorf("failed preparing message %v: %s", buf, err)
+	// Authorize the connection before calling any other option function with the request.
+	if b.authorize != nil {
+		if err := b.authorize(r); err != nil {
+			b.log(p, "Rejected connection: unauthorized", err)
+			status := http.StatusUnauthorized
+			if s, ok := err.(interface{ StatusCode() int }); ok {
+				status = s.StatusCode()
+			}
+			http.Error(w, http.StatusText(status), status)
+			return nil, fmt.Errorf("%w: %v", ErrRejected, err)
+		}
 	}
 
-	var failed []string
+	size, maxSize := b.buffer, b.buffer
+	if b.bufferFunc != nil {
+		if n := b.bufferFunc(r); n >= 0 {
+			size, maxSize = n, n
+		}
+	}
+	if b.dynamicBuffer {
+		size, maxSize = b.bufferMin, b.bufferMax
+	}
+	p.queue = newQueue(size, maxSize)
+	p.topics = r.URL.Query()[b.topicKey]
+	p.replay = r.URL.Query().Get("replay") == "1"
+	p.tls = r.TLS
+	if b.remoteAddr != nil {
+		p.addr = b.remoteAddr(r)
+	}
+	b.logLevel(LogDebug, p, "New connection", nil)
+	if b.resumeTTL > 0 {
+		p.resumeToken = newResumeToken()
+		p.resumeFrom = r.URL.Query().Get("resume")
+	}
+	if b.baseContext != nil {
+		p.ctx = b.baseContext(r)
+	}
+	if b.tags != nil {
+		p.tags = b.tags(r)
+	}
+	if b.maxConnectionsPerIP > 0 {
+		p.ip = b.clientIP(r)
+	}
+	p.queue.dropOldest = b.overflowPolicy == DropOldest
+	// An evicted message is never written, so release any `SendSync` that waits for it.
+	p.queue.onEvict = func(msg *message) { msg.written(p) }
+	p.queue.limit = b.bufferLimit
+	if b.onRecover != nil {
+		p.queue.onRecover = func() { b.onRecover(p) }
+	}
 
-	b.lock.Lock()
-	defer b.lock.Unlock()
-	for p := range b.pears {
-		select {
-		case p.ch <- msg:
-		default:
-			failed = append(failed, p.addr)
+	if b.connectMetadata != nil {
+		metadata, err := b.connectMetadata(r)
+		if err != nil {
+			b.log(p, "Rejected connection: metadata", err)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return nil, fmt.Errorf("%w: %v", ErrRejected, err)
 		}
+		p.metadata = metadata
 	}
 
-	if len(failed) > 0 {
-		b.logger("Discarded buffer overflow message for %s", strings.Join(failed, ","))
+	if b.evictKey != nil {
+		p.key = b.evictKey(r)
 	}
-	return nil
+
+	return p, nil
 }
 
-func (c *Beam) add(p *pear) {
-	c.lock.Lock()
-	defer c.lock.Unlock()
-	c.pears[p] = true
+// reject upgrades a connection that exceeds the maximum connections limit, and closes it with the
+// try again later close code. The reason is not replied with an HTTP error, since browsers can't
+// observe the HTTP status of a failed websocket handshake. For the same reason, the retry time is
+// sent in the close reason and not in a header.
+func (b *Beam) reject(w http.ResponseWriter, r *http.Request, p *Client, reason error) {
+	conn, err := b.upgrader.Upgrade(w, r, b.headers)
+	if err != nil {
+		b.log(p, "Failed creating websocket", err)
+		return
+	}
+	defer conn.Close()
+
+	text := reason.Error()
+	if seconds := b.retryAfterSeconds(); seconds > 0 {
+		text = fmt.Sprintf("%s, retry after %ds", text, seconds)
+	}
+	b.closeHandshake(p, conn, nil, websocket.CloseTryAgainLater, text)
 }
 
-func (c *Beam) remove(p *pear) {
-	c.lock.Lock()
-	defer c.lock.Unlock()
-	delete(c.pears, p)
+// setRetryAfter sets the Retry-After header of a rejected connection response, if it is enabled.
+func (b *Beam) setRetryAfter(h http.Header) {
+	if seconds := b.retryAfterSeconds(); seconds > 0 {
+		h.Set("Retry-After", strconv.Itoa(seconds))
+	}
 }
 
-// clientClosed return a channel that will be closed when the client is disconnected.
-func clientClosed(conn *websocket.Conn) <-chan struct{} {
-	done := make(chan struct{})
+// retryAfterSeconds returns the time after which a rejected client should retry to connect, in
+// whole seconds, or zero if it is not enabled.
+func (b *Beam) retryAfterSeconds() int {
+	if b.retryAfter == nil {
+		return 0
+	}
+	// The value is rounded up such that it is never zero.
+	seconds := int((b.retryAfter() + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	return seconds
+}
 
-	// Read client messages to detect when client close the connection.
-	go func() {
-		defer close(done)
-		for {
-			_, _, err := conn.ReadMessage()
-			if err != nil {
-				break
-			}
+// serve keeps writing to the connection until it is closed. It returns the reason for the
+// disconnection, which is nil if the client closed the connection.
+func (b *Beam) serve(p *Client, conn *websocket.Conn, done <-chan error) error {
+	if b.initialMessage != nil {
+		err := b.writeInitialMessage(p, conn)
+		if err != nil {
+			b.log(p, "Failed sending initial message", err)
+			b.closeHandshake(p, conn, done, websocket.CloseInternalServerErr, "")
+			return err
 		}
-	}()
+	}
 
-	return done
-}
+	var ping <-chan time.Time
+	if b.pingInterval > 0 && b.disconnectDetection != DetectNone {
+		t := time.NewTicker(b.pingInterval)
+		defer t.Stop()
+		ping = t.C
+	}
 
-func (b *Beam) log(p *pear, format string, args ...interface{}) {
-	if b.logger == nil {
+	idle, idleTimer := b.idleTimer(p)
+	if idleTimer != nil {
+		defer idleTimer.Stop()
+	}
+
+	pace := b.newPacer(p.queue)
+	write := func(v *message) error {
+		err := b.write(conn, v)
+		if err != nil {
+			b.log(p, "Failed writing to connection", err)
+			return err
+		}
+		v.written(p)
+		atomic.AddUint64(&b.totalSent, 1)
+		if idle != nil {
+			p.touch()
+		}
+		pace.wrote()
+		return nil
+	}
+
+	for {
+		select {
+		case <-ping:
+			err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(b.pingInterval))
+			if err != nil {
+				b.log(p, "Failed writing ping", err)
+				return err
+			}
+		case v := <-pace.out:
+			if err := write(v); err != nil {
+				return err
+			}
+		case <-pace.ready:
+			if v, ok := p.queue.pop(); ok {
+				if err := write(v); err != nil {
+					return err
+				}
+			}
+		case <-pace.resume:
+			pace.unpause()
+		case <-idle:
+			if d := b.idleTimeout - p.idleFor(); d > 0 {
+				idleTimer.Reset(d)
+				continue
+			}
+			b.log(p, "Idle timeout", nil)
+			b.closeHandshake(p, conn, done, websocket.CloseNormalClosure, ErrIdleTimeout.Error())
+			return ErrIdleTimeout
+		case err := <-done: // Wait for client to close the connection.
+			if err != nil {
+				b.log(p, "Failed reading connection", err)
+				return err
+			}
+			b.logLevel(LogDebug, p, "Client closed connection", nil)
+			return nil
+		case <-p.ctx.Done(): // The connection context is done.
+			b.logLevel(LogInfo, p, fmt.Sprintf("Context done: %s", p.ctx.Err()), nil)
+			b.closeHandshake(p, conn, done, b.closeCode, b.closeText)
+			return p.ctx.Err()
+		case <-p.closing: // The server terminated the connection.
+			b.log(p, p.termination.event, nil)
+			b.closeHandshake(p, conn, done, p.termination.code, p.termination.text)
+			return p.termination.reason
+		}
+	}
+}
+
+// idleTimer returns a timer for checking if a pear is idle, and its channel. If there is no idle
+// timeout, it returns nils.
+func (b *Beam) idleTimer(p *Client) (<-chan time.Time, *time.Timer) {
+	if b.idleTimeout <= 0 {
+		return nil, nil
+	}
+	p.touch()
+	t := time.NewTimer(b.idleTimeout)
+	return t.C, t
+}
+
+// writeInitialMessage writes the initial message of a pear directly to its connection.
+func (b *Beam) writeInitialMessage(p *Client, conn *websocket.Conn) error {
+	data, err := b.initialMessage(p)
+	if err != nil {
+		return err
+	}
+	msg, err := b.prepare(data)
+	if err != nil {
+		return err
+	}
+	return b.write(conn, msg)
+}
+
+// write writes a message to a connection.
+func (b *Beam) write(conn *websocket.Conn, msg *message) error {
+	if b.writeTimeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(b.writeTimeout))
+	}
+	if b.compressionThreshold > 0 {
+		// The prepared message keeps a frame for each compression setting, so each message is
+		// still compressed only once.
+		conn.EnableWriteCompression(msg.data == nil || len(msg.data) >= b.compressionThreshold)
+	}
+	return conn.WritePreparedMessage(msg.prepared)
+}
+
+// writeClose writes a close message to a connection. It returns whether the message was written.
+func (b *Beam) writeClose(p *Client, conn *websocket.Conn, code int, text string) bool {
+	msg := websocket.FormatCloseMessage(code, text)
+	err := conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(closeTimeout))
+	if err != nil {
+		b.log(p, "Failed writing close message", err)
+		return false
+	}
+	return true
+}
+
+// closeHandshake performs the closing handshake with the client of a connection that the server
+// disconnects: it writes a close message, and waits for the client to reply with a close message.
+// The done channel is the channel of the goroutine that reads from the connection (see
+// `clientClosed`). If it is nil, the connection is read directly, which is allowed only if there
+// is no other reader.
+func (b *Beam) closeHandshake(p *Client, conn *websocket.Conn, done <-chan error, code int, text string) {
+	if b.noCloseHandshake || !b.writeClose(p, conn, code, text) {
+		return
+	}
+
+	if done == nil {
+		conn.SetReadDeadline(time.Now().Add(closeTimeout))
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}
+
+	t := time.NewTimer(closeTimeout)
+	defer t.Stop()
+	select {
+	case <-done:
+	case <-t.C:
+	}
+}
+
+// Send the data to all connected connections.
+func (b *Beam) Send(data interface{}) error {
+	_, _, err := b.SendReport(data)
+	return err
+}
+
+// SendReport sends the data to all connected connections, and reports the number of connections
+// that the message was delivered to, and the number of connections that the message was discarded
+// for, due to a full buffer. A message is considered delivered once it is in the connection buffer.
+// If there are no connections, and the message does not need to be stored for future connections
+// (see `OptRetainLast` and `OptHistory`), the data is not even marshaled.
+func (b *Beam) SendReport(data interface{}) (delivered int, dropped int, err error) {
+	if b.empty() {
+		return 0, 0, nil
+	}
+	msg, err := b.prepareAll(data, 0)
+	if err != nil {
+		return 0, 0, err
+	}
+	delivered, failed, err := b.enqueue(context.Background(), msg, nil)
+	b.dropped(failed, data)
+	return delivered, len(failed), err
+}
+
+// SendDetailed sends the data to all connected connections, and reports the outcome for every
+// connection, by its address: nil if the message was delivered to the connection buffer, or
+// `ErrBufferFull` if it was discarded. If several connections have the same address (see
+// `OptRemoteAddr`), the entry is the error of any of them that the message was discarded for. The
+// error is returned if the data could not be marshaled, or if the beam is closed. If the beam is
+// paused, no connection is reported.
+func (b *Beam) SendDetailed(data interface{}) (map[string]error, error) {
+	msg, err := b.prepareAll(data, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	unlock, err := b.lockSend(true, msg)
+	if err == errPaused {
+		return map[string]error{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		results = map[string]error{}
+		failed  []*Client
+		mu      sync.Mutex
+	)
+	b.eachParallel(func(p *Client) bool {
+		added, ok := p.queue.pushReport(msg)
+		mu.Lock()
+		defer mu.Unlock()
+		if !ok {
+			failed = append(failed, p)
+		}
+		if !added {
+			results[p.addr] = ErrBufferFull
+		} else if _, exists := results[p.addr]; !exists {
+			results[p.addr] = nil
+		}
+		return true
+	})
+	unlock()
+	b.dropped(failed, data)
+	return results, nil
+}
+
+// SendTo sends the data only to connections that are subscribed to the given topic. Clients
+// subscribe to topics using a URL query parameter when connecting (see `OptTopicKey`), for example:
+// "/ws?topic=foo". A client can subscribe to multiple topics by repeating the parameter, for
+// example: "/ws?topic=foo&topic=bar". `Send` sends data to all connections, regardless of their
+// topics.
+//
+// A subscription that ends with "*" is a prefix pattern, and matches all the topics that start with
+// the rest of the subscription. For example, "sensors/*" matches "sensors/temp", "sensors/" and
+// "sensors/temp/max", but not "sensors". Only a single trailing "*" is a wildcard, any other "*" is
+// matched literally, so "a/*/*" matches "a/*/b" but not "a/b/c". The subscription "*" matches all
+// the topics, including the empty topic. Any other subscription matches only the exact topic.
+func (b *Beam) SendTo(topic string, data interface{}) error {
+	msg, err := b.prepare(data)
+	if err != nil {
+		return err
+	}
+	_, failed, err := b.enqueue(context.Background(), msg, func(p *Client) bool { return p.subscribed(topic) })
+	b.dropped(failed, data)
+	return err
+}
+
+// SendToTag sends the data only to connections that have the given tag (see `OptTags`).
+func (b *Beam) SendToTag(tag string, data interface{}) error {
+	msg, err := b.prepare(data)
+	if err != nil {
+		return err
+	}
+	_, failed, err := b.enqueue(context.Background(), msg, func(p *Client) bool { return p.tagged(tag) })
+	b.dropped(failed, data)
+	return err
+}
+
+// SendSample sends the data to a random sample of the connected connections, of about the given
+// fraction of them, for example, to try a new message format with 5% of the clients. A fraction of
+// zero or less sends to no connection, and a fraction of one or more sends to all of them. By
+// default, the connections are selected independently for every message. With `OptSampleSeed`,
+// the selection is deterministic.
+func (b *Beam) SendSample(fraction float64, data interface{}) error {
+	msg, err := b.prepare(data)
+	if err != nil {
+		return err
+	}
+	_, failed, err := b.enqueue(context.Background(), msg, func(p *Client) bool { return b.sampled(p, fraction) })
+	b.dropped(failed, data)
+	return err
+}
+
+// SendToAddr sends the data only to the connection with the given remote address (see
+// `Clients`). It returns whether a connection with this address was found.
+func (b *Beam) SendToAddr(addr string, data interface{}) (bool, error) {
+	msg, err := b.prepare(data)
+	if err != nil {
+		return false, err
+	}
+	delivered, failed, err := b.enqueue(context.Background(), msg, func(p *Client) bool { return p.addr == addr })
+	b.dropped(failed, data)
+	return delivered+len(failed) > 0, err
+}
+
+// SendFrom sends the data with the given sequence number only to the connections that did not
+// acknowledge it yet (see `Client.Ack`). The data is wrapped with the sequence number, as with
+// `OptSequence`, also if that option is not used. It can be used to resend missed messages, for
+// example, from a history that the caller keeps, or to send messages with sequence numbers that
+// the caller manages. The sequence numbers of the beam are not affected.
+func (b *Beam) SendFrom(seq uint64, data interface{}) error {
+	msg, err := b.encode(envelope{Seq: seq, Data: data}, 0)
+	if err != nil {
+		return err
+	}
+	_, failed, err := b.enqueue(context.Background(), msg, func(p *Client) bool { return p.Acked() < seq })
+	b.dropped(failed, data)
+	return err
+}
+
+// SendToMany sends the data only to the given clients, and returns the number of clients that the
+// message was delivered to. The data is marshaled once for all the clients. Clients that are no
+// longer connected, or that belong to another beam, are skipped, and the message is discarded for
+// clients with full buffers (see `OptOnDrop`).
+func (b *Beam) SendToMany(clients []*Client, data interface{}) (int, error) {
+	msg, err := b.prepare(data)
+	if err != nil {
+		return 0, err
+	}
+
+	unlock, err := b.lockSend(false)
+	if err == errPaused {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	var (
+		delivered int
+		failed    []*Client
+	)
+	seen := make(map[*Client]bool, len(clients))
+	for _, p := range clients {
+		if p.beam != b || seen[p] || !p.Connected() {
+			continue
+		}
+		seen[p] = true
+		p.shard.lock.RLock()
+		if p.shard.pears[p] {
+			if p.queue.push(msg) {
+				delivered++
+			} else {
+				failed = append(failed, p)
+			}
+		}
+		p.shard.lock.RUnlock()
+	}
+	unlock()
+
+	b.dropped(failed, data)
+	return delivered, nil
+}
+
+// SendExcept sends the data to all connected connections, except the given client. It can be used to
+// broadcast a message of a client to all the other clients. Since the message is not sent to all the
+// connections, it is not retained.
+func (b *Beam) SendExcept(exclude *Client, data interface{}) error {
+	msg, err := b.prepare(data)
+	if err != nil {
+		return err
+	}
+	_, failed, err := b.enqueue(context.Background(), msg, func(p *Client) bool { return p != exclude })
+	b.dropped(failed, data)
+	return err
+}
+
+// SendFunc sends the data only to connections for which the match function returns true. The data
+// is marshaled only once for all the matching connections. The match function is called while the
+// beam is locked, and should not call any of the beam methods.
+func (b *Beam) SendFunc(data interface{}, match func(c *Client) bool) error {
+	msg, err := b.prepare(data)
+	if err != nil {
+		return err
+	}
+	_, failed, err := b.enqueue(context.Background(), msg, match)
+	b.dropped(failed, data)
+	return err
+}
+
+// SendMany sends a batch of data items to all connected connections, in order. All the items are
+// prepared before any of them is sent, and the beam is locked only once for the whole batch.
+// Discarded messages are reported for each item separately.
+func (b *Beam) SendMany(items []interface{}) error {
+	if len(items) == 0 {
+		return nil
+	}
+	msgs := make([]*message, 0, len(items))
+	sent := make([]interface{}, 0, len(items))
+	for _, item := range items {
+		msg, err := b.prepareAll(item, 0)
+		if err == ErrDuplicate {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		msgs = append(msgs, msg)
+		sent = append(sent, item)
+	}
+	if len(msgs) == 0 {
+		return ErrDuplicate
+	}
+
+	unlock, err := b.lockSend(true, msgs...)
+	if err == errPaused {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	failed := make([][]*Client, len(msgs))
+	b.each(func(p *Client) bool {
+		for i, msg := range msgs {
+			if !p.queue.push(msg) {
+				failed[i] = append(failed[i], p)
+			}
+		}
+		return true
+	})
+	unlock()
+
+	for i, item := range sent {
+		b.dropped(failed[i], item)
+	}
+	return nil
+}
+
+// SendEach sends a different data to each of the connected connections. The build function is
+// called for every connection and returns the data that should be sent to it. It can return
+// `ErrSkip` to skip the connection. Any other error stops the sending and is returned. The build
+// function is called while the beam is locked, and should not call any of the beam methods.
+func (b *Beam) SendEach(build func(c *Client) (interface{}, error)) error {
+	unlock, err := b.lockSend(false)
+	if err == errPaused {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var (
+		failed     []*Client
+		failedData []interface{}
+	)
+	b.each(func(p *Client) bool {
+		var data interface{}
+		data, err = build(p)
+		if err == ErrSkip {
+			err = nil
+			return true
+		}
+		if err != nil {
+			return false
+		}
+		var msg *message
+		msg, err = b.prepare(data)
+		if err != nil {
+			return false
+		}
+		if !p.queue.push(msg) {
+			failed = append(failed, p)
+			failedData = append(failedData, data)
+		}
+		return true
+	})
+	unlock()
+
+	if b.onDrop == nil {
+		b.dropped(failed, nil)
+		return err
+	}
+	for i, p := range failed {
+		b.dropped([]*Client{p}, failedData[i])
+	}
+	return err
+}
+
+// SendTyped sends the data to all connected connections, as `Send` does, but with the given
+// message type, which should be either `websocket.TextMessage` or `websocket.BinaryMessage`. The
+// message type overrides the message type of the beam (see `OptMessageType`) and of the encoder (see
+// `OptEncoder`).
+func (b *Beam) SendTyped(messageType int, data interface{}) error {
+	if messageType != websocket.TextMessage && messageType != websocket.BinaryMessage {
+		return &PrepareError{Err: fmt.Errorf("invalid message type %d", messageType)}
+	}
+	if b.empty() {
+		return nil
+	}
+	msg, err := b.prepareAll(data, messageType)
+	if err != nil {
+		return err
+	}
+	return b.send(data, msg)
+}
+
+// SendText sends a string to all connected connections as a text message, without marshaling it.
+func (b *Beam) SendText(s string) error {
+	return b.SendBytes([]byte(s), websocket.TextMessage)
+}
+
+// SendBytes sends raw data to all connected connections, without marshaling it. The message type
+// should be either `websocket.TextMessage` or `websocket.BinaryMessage`.
+func (b *Beam) SendBytes(data []byte, messageType int) error {
+	msg, err := prepareBytes(data, messageType)
+	if err != nil {
+		return err
+	}
+	return b.send(data, msg)
+}
+
+// SendAuto sends raw data to all connected connections, without marshaling it, and chooses the
+// message type by the data: a text message if the data is valid UTF-8, as the websocket protocol
+// requires for text messages, and a binary message otherwise. Empty data is sent as a text
+// message.
+func (b *Beam) SendAuto(data []byte) error {
+	messageType := websocket.BinaryMessage
+	if utf8.Valid(data) {
+		messageType = websocket.TextMessage
+	}
+	return b.SendBytes(data, messageType)
+}
+
+// SendStream sends data of a logical stream to all connected connections, for multiplexing several
+// streams over a single connection. The data is sent as a binary message, prefixed with the stream
+// ID as a 4 bytes big-endian integer, that the clients can use to demultiplex the messages.
+func (b *Beam) SendStream(streamID uint32, data []byte) error {
+	framed := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(framed, streamID)
+	copy(framed[4:], data)
+	return b.SendBytes(framed, websocket.BinaryMessage)
+}
+
+// SendPrepared sends a prepared message to all connected connections. It can be used to send the
+// same message with multiple beams, while marshaling it only once (see `Prepare`). Since the raw
+// data of a prepared message is not available, the message is not sent to SSE connections, and the
+// data that is reported for discarded messages (see `OptOnDrop`) is nil.
+func (b *Beam) SendPrepared(msg *websocket.PreparedMessage) error {
+	return b.send(nil, &message{prepared: msg})
+}
+
+// Prepare marshals the data to JSON and returns a prepared websocket text message, that can be sent
+// with `SendPrepared`. It does not apply the encoder and message type options of any beam.
+func Prepare(data interface{}) (*websocket.PreparedMessage, error) {
+	msg, err := prepareJSON(data, websocket.TextMessage)
+	if err != nil {
+		return nil, err
+	}
+	return msg.prepared, nil
+}
+
+// SendContext sends the data to all connected connections, as long as the context is not done. If
+// the context is done, it returns the context error, and the data is sent only to the connections
+// that were reached before that.
+func (b *Beam) SendContext(ctx context.Context, data interface{}) error {
+	msg, err := b.prepareAll(data, 0)
+	if err != nil {
+		return err
+	}
+	return b.sendContext(ctx, data, msg)
+}
+
+// Pump sends every value that is received from the channel to all connected connections, until the
+// channel is closed or the context is done. It returns nil when the channel is closed, or the
+// context error when the context is done. If sending a value fails, the error is returned, except
+// for `ErrDuplicate`, which only skips the value (see `OptDedupe`).
+func (b *Beam) Pump(ctx context.Context, ch <-chan interface{}) error {
+	return pump(ctx, ch, b.Send)
+}
+
+// pump sends the values of a channel with the send function, until the channel is closed or the
+// context is done.
+func pump[T any](ctx context.Context, ch <-chan T, send func(T) error) error {
+	for {
+		select {
+		case v, ok := <-ch:
+			if !ok {
+				return nil
+			}
+			if err := send(v); err != nil && err != ErrDuplicate {
+				return err
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// SendWait sends the data to all connected connections. Unlike `Send`, it does not discard the
+// message for connections with full buffers, and instead waits until they have room for it, or
+// until they are disconnected. A connection that does not read messages blocks SendWait, as well
+// as any other operation on the beam, until it is disconnected. It is therefore recommended to
+// use SendWait together with `OptWriteTimeout`, which ensures that stuck connections are
+// disconnected in a bounded time.
+func (b *Beam) SendWait(data interface{}) error {
+	msg, err := b.prepareAll(data, 0)
+	if err != nil {
+		return err
+	}
+
+	unlock, err := b.lockSend(true, msg)
+	if err == errPaused {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	b.eachParallel(func(p *Client) bool {
+		p.queue.pushWait(msg, p.done)
+		return true
+	})
+	return nil
+}
+
+// SendSync sends the data to all connected connections, and waits until all of them have written
+// it to their connection, or until they are disconnected. It returns the context error if the
+// context is done before that. As with `Send`, the message is discarded for connections with full
+// buffers, and SendSync does not wait for them.
+func (b *Beam) SendSync(ctx context.Context, data interface{}) error {
+	msg, err := b.prepareAll(data, 0)
+	if err != nil {
+		return err
+	}
+
+	unlock, err := b.lockSend(true, msg)
+	if err == errPaused {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// The acknowledgements are created before the message is enqueued to any of the pears, since
+	// they are read when the message is written. Pears may be added after the acknowledgements were
+	// created, unless the beam stores messages for new pears, and the message is not sent to them,
+	// as if they were added after the message was sent. The acknowledgements are set on a copy of
+	// the message, such that a stored message does not keep the pears in memory.
+	synced := *msg
+	msg = &synced
+	msg.acks = map[*Client]chan struct{}{}
+	b.each(func(p *Client) bool {
+		msg.acks[p] = make(chan struct{})
+		return true
+	})
+	var (
+		delivered []*Client
+		failed    []*Client
+		mu        sync.Mutex
+	)
+	b.eachParallel(func(p *Client) bool {
+		if msg.acks[p] == nil {
+			return true
+		}
+		added, ok := p.queue.pushReport(msg)
+		mu.Lock()
+		defer mu.Unlock()
+		if added {
+			delivered = append(delivered, p)
+		}
+		if !ok {
+			failed = append(failed, p)
+		}
+		return true
+	})
+	unlock()
+	b.dropped(failed, data)
+
+	for _, p := range delivered {
+		select {
+		case <-msg.acks[p]:
+		case <-p.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// send enqueues a prepared message to all the connected pears. The data is the value that the
+// message was prepared from.
+func (b *Beam) send(data interface{}, msg *message) error {
+	return b.sendContext(context.Background(), data, msg)
+}
+
+// sendContext enqueues a prepared message to all the connected pears, until the context is done.
+func (b *Beam) sendContext(ctx context.Context, data interface{}, msg *message) error {
+	_, failed, err := b.enqueue(ctx, msg, nil)
+	b.dropped(failed, data)
+	return err
+}
+
+// enqueue enqueues a prepared message to all the connected pears that match, until the context is
+// done. A nil match function matches all the pears. It returns the number of pears that the
+// message was enqueued to, and the pears for which the message was discarded due to a full buffer.
+func (b *Beam) enqueue(ctx context.Context, msg *message, match func(*Client) bool) (int, []*Client, error) {
+	var (
+		delivered int
+		failed    []*Client
+		mu        sync.Mutex
+	)
+
+	unlock, err := b.lockSend(match == nil, msg)
+	if err == errPaused {
+		return 0, nil, nil
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	defer unlock()
+
+	b.eachParallel(func(p *Client) bool {
+		if match != nil && !match(p) {
+			return true
+		}
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			mu.Lock()
+			err = ctxErr
+			mu.Unlock()
+			return false
+		}
+		added, ok := p.queue.pushReport(msg)
+		mu.Lock()
+		defer mu.Unlock()
+		if added {
+			delivered++
+		}
+		if !ok {
+			failed = append(failed, p)
+		}
+		return true
+	})
+	return delivered, failed, err
+}
+
+// empty returns whether a message that is sent to all the pears can be discarded without preparing
+// it: the beam is open, has no pears, and does not store messages for new pears.
+func (b *Beam) empty() bool {
+	if b.retainLast || b.history != nil {
+		return false
+	}
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	return !b.closed && b.Count() == 0
+}
+
+// lockSend prepares the beam for sending messages. It fails if the beam is closed, or with
+// errPaused if the beam is paused. When the messages are sent to all the pears and retaining the
+// last message or the history is enabled, it stores the messages, also when the beam is paused, and
+// keeps the beam locked until the returned unlock function is called, such that new pears get
+// either the stored messages, or the messages themselves, but not both. If it fails, the hashes that
+// the messages recorded for deduplication are restored (see `OptDedupe`).
+func (b *Beam) lockSend(all bool, msgs ...*message) (unlock func(), err error) {
+	defer func() {
+		if err != nil {
+			b.unrecord(msgs)
+		}
+	}()
+
+	if all && (b.retainLast || b.history != nil) {
+		b.lock.Lock()
+		if b.closed {
+			b.lock.Unlock()
+			return nil, ErrClosed
+		}
+		if b.retainLast {
+			b.retained = msgs[len(msgs)-1]
+		}
+		if b.history != nil {
+			for _, msg := range msgs {
+				b.history.add(msg)
+			}
+		}
+		if b.paused {
+			b.lock.Unlock()
+			return nil, errPaused
+		}
+		return b.lock.Unlock, nil
+	}
+
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	if b.closed {
+		return nil, ErrClosed
+	}
+	if b.paused {
+		return nil, errPaused
+	}
+	return func() {}, nil
+}
+
+// dropped reports the pears for which a message was discarded. It should be called without holding
+// the lock.
+func (b *Beam) dropped(failed []*Client, data interface{}) {
+	if len(failed) == 0 {
+		return
+	}
+	atomic.AddUint64(&b.totalDropped, uint64(len(failed)))
+
+	if b.onDrop != nil {
+		for _, p := range failed {
+			b.onDrop(p, data)
+		}
+		return
+	}
+
+	if b.logger == nil && b.structuredLogger == nil || LogWarn < b.minLogLevel {
+		return
+	}
+	addrs := make([]string, 0, len(failed))
+	for _, p := range failed {
+		addrs = append(addrs, p.addr)
+	}
+	if b.structuredLogger != nil {
+		b.structuredLogger(LogWarn.String(), "Discarded buffer overflow message", map[string]interface{}{"addrs": addrs})
+		return
+	}
+	b.logger("%s Discarded buffer overflow message for %s", LogWarn, strings.Join(addrs, ","))
+}
+
+// message is a message that is sent to pears. It holds both the prepared websocket message, for
+// websocket connections, and the raw data, for SSE connections.
+type message struct {
+	prepared    *websocket.PreparedMessage
+	messageType int
+	data        []byte
+	// acks are closed when the message is written to the pears, for messages that are sent with
+	// `SendSync`. It is not modified after the message is enqueued, and is not set on messages that
+	// the beam stores for new pears.
+	acks map[*Client]chan struct{}
+	// deduped is set for messages that recorded their hash as the last hash of the beam (see
+	// `OptDedupe`). The hash and the previous last hash are kept, such that the previous one can be
+	// restored if the message is not sent.
+	deduped        bool
+	hash, prevHash uint64
+}
+
+// written acknowledges that the message was written to the pear, or that it was discarded after it
+// was buffered, such that it will never be written.
+func (m *message) written(p *Client) {
+	if ack := m.acks[p]; ack != nil {
+		close(ack)
+	}
+}
+
+// encoder is a JSON encoder that encodes into its own buffer.
+type encoder struct {
+	buf bytes.Buffer
+	enc *json.Encoder
+}
+
+// encoders is a pool of encoders, used to reduce allocations when marshaling messages.
+var encoders = sync.Pool{
+	New: func() interface{} {
+		e := &encoder{}
+		e.enc = json.NewEncoder(&e.buf)
+		return e
+	},
+}
+
+// envelope wraps the data of a message with its sequence number (see `OptSequence`).
+type envelope struct {
+	Seq  uint64      `json:"seq"`
+	Data interface{} `json:"data"`
+}
+
+// prepareAll prepares a message that is sent to all the pears, with the given message type, or with
+// the default message type if it is zero. When sequence numbers are enabled, the message gets the
+// next sequence number. When deduplication is enabled, it returns ErrDuplicate if the message is
+// identical to the previous one.
+func (b *Beam) prepareAll(data interface{}, messageType int) (*message, error) {
+	if b.dedupe {
+		msg, err := b.encode(data, messageType)
+		if err != nil {
+			return nil, err
+		}
+		if b.duplicate(msg) {
+			return nil, ErrDuplicate
+		}
+		if !b.sequence {
+			return msg, nil
+		}
+	}
+	if b.sequence {
+		return b.encode(envelope{Seq: atomic.AddUint64(&b.seq, 1), Data: data}, messageType)
+	}
+	return b.encode(data, messageType)
+}
+
+// duplicate records the hash of the encoded data of a message that is sent to all the pears, and
+// returns whether it is identical to the hash of the previous message.
+func (b *Beam) duplicate(msg *message) bool {
+	h := fnv.New64a()
+	h.Write(msg.data)
+	msg.hash = h.Sum64()
+	msg.prevHash = atomic.SwapUint64(&b.lastHash, msg.hash)
+	msg.deduped = true
+	return msg.prevHash == msg.hash
+}
+
+// unrecord restores the last hash of the beam for messages that were not sent, such that a message
+// that no pear received is not considered as the previous message. The hash is restored only if no
+// other message was recorded since.
+func (b *Beam) unrecord(msgs []*message) {
+	for i := len(msgs) - 1; i >= 0; i-- {
+		if msg := msgs[i]; msg.deduped {
+			atomic.CompareAndSwapUint64(&b.lastHash, msg.hash, msg.prevHash)
+		}
+	}
+}
+
+// sampled returns whether a pear is in a sample of the given fraction of the pears (see
+// `SendSample`). With a seed, the pear is selected by a hash of the seed and its address, which is
+// uniformly distributed between 0 and 1.
+func (b *Beam) sampled(p *Client, fraction float64) bool {
+	if !b.sampleSeeded {
+		return rand.Float64() < fraction
+	}
+	h := fnv.New64a()
+	var seed [8]byte
+	binary.BigEndian.PutUint64(seed[:], b.sampleSeed)
+	h.Write(seed[:])
+	h.Write([]byte(p.addr))
+	// Use the 53 high bits, which are exactly representable by a float64.
+	return float64(h.Sum64()>>11)/(1<<53) < fraction
+}
+
+// prepare prepares a message that is not sent to all the pears. When sequence numbers are enabled,
+// the message is wrapped without a sequence number.
+func (b *Beam) prepare(data interface{}) (*message, error) {
+	if b.sequence {
+		return b.encode(envelope{Data: data}, 0)
+	}
+	return b.encode(data, 0)
+}
+
+// encode encodes the data with the beam encoder and returns a prepared websocket message. A non-zero
+// message type overrides the message type of the beam and of the encoder. When payload compression
+// is enabled, the encoded data is compressed into a binary message.
+func (b *Beam) encode(data interface{}, messageType int) (*message, error) {
+	msg, err := b.encodeRaw(data, messageType)
+	if err != nil || !b.gzipPayload {
+		return msg, err
+	}
+	return prepareGzip(msg.data)
+}
+
+// encodeRaw encodes the data with the beam encoder, without compression.
+func (b *Beam) encodeRaw(data interface{}, messageType int) (*message, error) {
+	if b.encoder == nil {
+		if messageType == 0 {
+			messageType = b.messageType
+		}
+		return prepareJSON(data, messageType)
+	}
+	buf, encoderType, err := b.encoder(data)
+	if err != nil {
+		return nil, &MarshalError{Data: data, Err: fmt.Errorf("encoder: %w", err)}
+	}
+	if messageType == 0 {
+		messageType = encoderType
+	}
+	return prepareBytes(buf, messageType)
+}
+
+// gzipWriters is a pool of gzip writers, used to reduce allocations when compressing payloads.
+var gzipWriters = sync.Pool{
+	New: func() interface{} { return gzip.NewWriter(nil) },
+}
+
+// prepareGzip compresses the data with gzip and returns a prepared binary websocket message.
+func prepareGzip(data []byte) (*message, error) {
+	var buf bytes.Buffer
+	w := gzipWriters.Get().(*gzip.Writer)
+	defer gzipWriters.Put(w)
+	w.Reset(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, &PrepareError{Err: fmt.Errorf("compressing payload: %w", err)}
+	}
+	if err := w.Close(); err != nil {
+		return nil, &PrepareError{Err: fmt.Errorf("compressing payload: %w", err)}
+	}
+	return prepareBytes(buf.Bytes(), websocket.BinaryMessage)
+}
+
+// prepareJSON marshals the data to JSON and returns a prepared websocket message of the given type.
+func prepareJSON(data interface{}, messageType int) (*message, error) {
+	e := encoders.Get().(*encoder)
+	defer encoders.Put(e)
+	e.buf.Reset()
+
+	err := e.enc.Encode(data)
+	if err != nil {
+		return nil, &MarshalError{Data: data, Err: err}
+	}
+	// Remove the newline that the encoder adds, to be identical to `json.Marshal`. The prepared
+	// message copies the data, so the buffer can be reused afterwards.
+	return prepareBytes(bytes.TrimSuffix(e.buf.Bytes(), []byte("\n")), messageType)
+}
+
+// prepareBytes returns a prepared websocket message of the given raw data.
+func prepareBytes(data []byte, messageType int) (*message, error) {
+	prepared, err := websocket.NewPreparedMessage(messageType, data)
+	if err != nil {
+		return nil, &PrepareError{Err: err}
+	}
+	// The prepared message keeps its own copy of the data, the raw data is copied as well, since the
+	// given data may be reused by the caller.
+	return &message{
+		prepared:    prepared,
+		messageType: messageType,
+		data:        append([]byte(nil), data...),
+	}, nil
+}
+
+// Stats are statistics of a beam.
+type Stats struct {
+	// Connected is the number of currently connected connections.
+	Connected int
+	// TotalConnections is the number of connections that were ever connected.
+	TotalConnections uint64
+	// TotalSent is the number of messages that were written to connections.
+	TotalSent uint64
+	// TotalDropped is the number of messages that were discarded due to full buffers.
+	TotalDropped uint64
+	// BufferedBytes is the total size of the messages that are buffered for the connections, when
+	// the size is limited (see `OptMaxBufferedBytes`).
+	BufferedBytes int64
+}
+
+// Stats returns the current statistics of the beam.
+func (b *Beam) Stats() Stats {
+	s := Stats{
+		Connected:        b.Count(),
+		TotalConnections: atomic.LoadUint64(&b.totalConnections),
+		TotalSent:        atomic.LoadUint64(&b.totalSent),
+		TotalDropped:     atomic.LoadUint64(&b.totalDropped),
+	}
+	if b.bufferLimit != nil {
+		s.BufferedBytes = atomic.LoadInt64(&b.bufferLimit.used)
+	}
+	return s
+}
+
+// Count returns the number of currently connected connections.
+func (b *Beam) Count() int {
+	return int(atomic.LoadInt64(&b.count))
+}
+
+// Pressure returns the maximum fill ratio of the connection buffers, between 0, when all the buffers
+// are empty, and 1, when at least one of the buffers is full. Producers can poll it to slow down
+// when connections fall behind, before messages are dropped. For buffers that are grown on demand
+// (see `OptDynamicBuffer`), the ratio is relative to the maximum size.
+func (b *Beam) Pressure() float64 {
+	var pressure float64
+	b.each(func(p *Client) bool {
+		if f := p.queue.fill(); f > pressure {
+			pressure = f
+		}
+		return pressure < 1
+	})
+	return pressure
+}
+
+// ForEach calls fn for every connected client. The clients are collected before fn is called,
+// without holding any lock while it runs, so fn may block, and may call any method of the beam or of
+// the clients, such as `Client.Send`. Clients that connect during the iteration are not visited,
+// and clients that disconnect during the iteration may still be visited (see `Client.Connected`).
+func (b *Beam) ForEach(fn func(c *Client)) {
+	pears := make([]*Client, 0, b.Count())
+	b.each(func(p *Client) bool {
+		pears = append(pears, p)
+		return true
+	})
+	for _, p := range pears {
+		fn(p)
+	}
+}
+
+// Clients returns the remote addresses of all the connected connections.
+func (b *Beam) Clients() []string {
+	addrs := make([]string, 0, b.Count())
+	b.each(func(p *Client) bool {
+		addrs = append(addrs, p.addr)
+		return true
+	})
+	return addrs
+}
+
+// Healthy returns whether the beam is operational: it was not closed, and is not paused.
+func (b *Beam) Healthy() bool {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	return !b.closed && !b.paused
+}
+
+// HealthHandler returns an HTTP handler that can be used for readiness probes. It replies with HTTP
+// 200 status if the beam is healthy (see `Healthy`), and with HTTP 503 status otherwise.
+func (b *Beam) HealthHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !b.Healthy() {
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// DebugHandler returns an HTTP handler that replies with the state of the beam as JSON, for
+// debugging: the statistics (see `Stats`), whether the beam is paused or closed, and, for every
+// connection, its address, buffer usage and age. It exposes the addresses of the clients, so it
+// should be served only to operators.
+func (b *Beam) DebugHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		stats := b.Stats()
+		state := debugState{
+			Connected:        stats.Connected,
+			TotalConnections: stats.TotalConnections,
+			TotalSent:        stats.TotalSent,
+			TotalDropped:     stats.TotalDropped,
+			BufferedBytes:    stats.BufferedBytes,
+			Clients:          []debugClient{},
+		}
+		b.lock.RLock()
+		state.Paused, state.Closed = b.paused, b.closed
+		b.lock.RUnlock()
+		b.each(func(p *Client) bool {
+			state.Clients = append(state.Clients, debugClient{
+				Addr:     p.addr,
+				QueueLen: p.QueueLen(),
+				QueueCap: p.QueueCap(),
+				Age:      p.Age().String(),
+			})
+			return true
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(state); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+// debugState is the state of the beam that is returned by the debug handler.
+type debugState struct {
+	Connected        int           `json:"connected"`
+	TotalConnections uint64        `json:"total_connections"`
+	TotalSent        uint64        `json:"total_sent"`
+	TotalDropped     uint64        `json:"total_dropped"`
+	BufferedBytes    int64         `json:"buffered_bytes"`
+	Paused           bool          `json:"paused"`
+	Closed           bool          `json:"closed"`
+	Clients          []debugClient `json:"clients"`
+}
+
+// debugClient is the state of a connection that is returned by the debug handler.
+type debugClient struct {
+	Addr     string `json:"addr"`
+	QueueLen int    `json:"queue_len"`
+	QueueCap int    `json:"queue_cap"`
+	Age      string `json:"age"`
+}
+
+// Pause pauses broadcasting. While the beam is paused, the connections are kept open, but data that
+// is sent with the beam methods, such as `Send`, is discarded without an error, and is not counted as
+// dropped. Messages that were already buffered before the pause are still written to the
+// connections. When retaining the last message is enabled, data that is sent to all connections is
+// still retained, and new connections receive it upon connection. Sending data to a single
+// connection with `Client.Send` is not affected by the pause. It is safe to call Pause more than
+// once.
+func (b *Beam) Pause() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.paused = true
+}
+
+// Resume resumes broadcasting after a call to `Pause`. Data that was sent while the beam was paused
+// is not sent to the connections.
+func (b *Beam) Resume() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.paused = false
+}
+
+// Close disconnects all connected connections and rejects new connections with HTTP 503 status.
+// Any following call to `Send` will return `ErrClosed`. It is safe to call Close more than once.
+func (b *Beam) Close() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.closed = true
+	b.terminateAll(b.closeTermination())
+	return nil
+}
+
+// DisconnectAll disconnects all the connections with the given close code and text, and waits until
+// they are no longer served. Unlike `Close`, the beam keeps accepting new connections. The
+// disconnection reason of the connections is `ErrDisconnectAll`. Messages that are sent
+// concurrently are either written to the connections before they are disconnected, or are not sent
+// to them. It should not be called from the beam callbacks, such as the connect function, since it
+// waits for them to return.
+func (b *Beam) DisconnectAll(code int, text string) {
+	// Hold the lock such that pears are not added while the pears are terminated.
+	b.lock.RLock()
+	pears := b.terminateAll(termination{reason: ErrDisconnectAll, code: code, text: text, event: "Disconnected all"})
+	b.lock.RUnlock()
+	waitDone(context.Background(), pears)
+}
+
+// EvictOldest disconnects the n connections that were connected for the longest time, for example,
+// to shed load when the beam is close to its connections limit. The connections are closed with
+// the "try again later" close code, and their disconnection reason is `ErrEvictedOldest`. It does
+// not wait for the connections to be disconnected.
+func (b *Beam) EvictOldest(n int) {
+	if n <= 0 {
+		return
+	}
+	pears := make([]*Client, 0, b.Count())
+	b.each(func(p *Client) bool {
+		pears = append(pears, p)
+		return true
+	})
+	sort.Slice(pears, func(i, j int) bool { return pears[i].connectedAt.Before(pears[j].connectedAt) })
+	if n < len(pears) {
+		pears = pears[:n]
+	}
+
+	t := termination{
+		reason: ErrEvictedOldest,
+		code:   websocket.CloseTryAgainLater,
+		text:   ErrEvictedOldest.Error(),
+		event:  "Evicted oldest",
+	}
+	for _, p := range pears {
+		p.shard.lock.Lock()
+		b.terminateLocked(p, t)
+		p.shard.lock.Unlock()
+	}
+}
+
+// Shutdown gracefully closes the beam. It rejects new connections, waits for all the buffered
+// messages to be written to the connections, and then disconnects them. If the context is done
+// before all connections were disconnected, the remaining connections are closed forcibly and the
+// context error is returned. Any following call to `Send` will return `ErrClosed`.
+func (b *Beam) Shutdown(ctx context.Context) error {
+	b.lock.Lock()
+	b.closed = true
+	b.lock.Unlock()
+
+	pears := make([]*Client, 0, b.Count())
+	b.each(func(p *Client) bool {
+		pears = append(pears, p)
+		return true
+	})
+
+	err := waitDrained(ctx, pears)
+
+	b.lock.Lock()
+	b.terminateAll(b.closeTermination())
+	b.lock.Unlock()
+
+	if err == nil {
+		err = waitDone(ctx, pears)
+	}
+	if err != nil {
+		for _, p := range pears {
+			// SSE pears do not have a websocket connection, they are terminated by their handler.
+			if p.conn != nil {
+				p.conn.Close()
+			}
+		}
+	}
+	return err
+}
+
+// shutdownPollInterval is the interval for checking if buffers were drained during shutdown.
+const shutdownPollInterval = 10 * time.Millisecond
+
+// waitDrained waits until the buffers of all the given pears are empty, or until they are no longer
+// served. It returns the context error if the context is done before that.
+func waitDrained(ctx context.Context, pears []*Client) error {
+	t := time.NewTicker(shutdownPollInterval)
+	defer t.Stop()
+	for {
+		drained := true
+		for _, p := range pears {
+			select {
+			case <-p.done:
+			default:
+				if p.queue.len() > 0 {
+					drained = false
+				}
+			}
+		}
+		if drained {
+			return nil
+		}
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// waitDone waits until all the given pears are no longer served. It returns the context error if
+// the context is done before that.
+func waitDone(ctx context.Context, pears []*Client) error {
+	for _, p := range pears {
+		select {
+		case <-p.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// clientIP returns the IP of the client of a connection request.
+func (b *Beam) clientIP(r *http.Request) string {
+	if b.trustForwardedFor {
+		if fwd := r.Header.Values("X-Forwarded-For"); len(fwd) > 0 {
+			addrs := strings.Split(fwd[len(fwd)-1], ",")
+			if ip := strings.TrimSpace(addrs[len(addrs)-1]); ip != "" {
+				return ip
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// checkOrigin checks the origin header of a request against the allowed origins.
+func (b *Beam) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	for _, allowed := range b.allowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientClosed return a channel that will receive a value when the client is disconnected. The
+// value is nil if the client closed the connection cleanly, or the read error otherwise. The channel
+// is closed when the reading goroutine exits.
+func (b *Beam) clientClosed(p *Client, conn *websocket.Conn) <-chan error {
+	done := make(chan error, 1)
+
+	if b.readLimit > 0 {
+		conn.SetReadLimit(b.readLimit)
+	}
+
+	// When pings are sent, require the client to respond with pongs in time.
+	if b.pingInterval > 0 {
+		pongWait := 2 * b.pingInterval
+		conn.SetReadDeadline(time.Now().Add(pongWait))
+		conn.SetPongHandler(func(string) error {
+			return conn.SetReadDeadline(time.Now().Add(pongWait))
+		})
+	}
+
+	var limit *limiter
+	if b.readRate > 0 {
+		limit = newLimiter(b.readRate, b.readRate)
+	}
+
+	// Read client messages to detect when client close the connection.
+	go func() {
+		for {
+			messageType, data, err := conn.ReadMessage()
+			if err != nil {
+				if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+					err = nil
+				}
+				done <- err
+				close(done)
+				return
+			}
+			if b.idleTimeout > 0 {
+				p.touch()
+			}
+			if limit != nil && !limit.allow(time.Now()) {
+				if !b.readRateDisconnect {
+					continue
+				}
+				b.logLevel(LogWarn, p, "Read rate limit exceeded", nil)
+				b.closeHandshake(p, conn, nil, websocket.ClosePolicyViolation, "")
+				done <- ErrReadRateLimit
+				close(done)
+				return
+			}
+			if b.onMessage != nil {
+				b.onMessage(p, messageType, data)
+			}
+			if b.onRequest != nil {
+				b.request(p, messageType, data)
+			}
+		}
+	}()
+
+	return done
+}
+
+// request handles a message of a pear with the request function, and sends the reply to the pear.
+func (b *Beam) request(p *Client, messageType int, data []byte) {
+	reply, err := b.onRequest(p, messageType, data)
+	if err != nil {
+		b.log(p, "Failed handling request", err)
+		return
+	}
+	if reply == nil {
+		return
+	}
+	if err := p.Send(reply); err != nil {
+		b.log(p, "Failed sending reply", err)
+	}
+}
+
+// offersDeflate returns whether the request headers offer the permessage-deflate extension. This is
+// the condition under which the gorilla upgrader negotiates compression when it is enabled, since
+// the negotiated extensions are not exposed by the connection.
+func offersDeflate(h http.Header) bool {
+	for _, v := range h["Sec-Websocket-Extensions"] {
+		for _, ext := range strings.Split(v, ",") {
+			if name := strings.SplitN(ext, ";", 2)[0]; strings.TrimSpace(name) == "permessage-deflate" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// log logs an event of a pear, with an optional error. Events with an error are logged with the
+// error level, and are reported to the error function. Other events are logged with the info level.
+func (b *Beam) log(p *Client, msg string, err error) {
+	level := LogInfo
+	if err != nil {
+		level = LogError
+	}
+	b.logLevel(level, p, msg, err)
+}
+
+// logLevel logs an event of a pear with the given level, if it is not below the minimal level, and
+// reports its error, if any, to the error function.
+func (b *Beam) logLevel(level LogLevel, p *Client, msg string, err error) {
+	if err != nil && b.onError != nil {
+		b.onError(p, err)
+	}
+	if level < b.minLogLevel {
+		return
+	}
+	if b.structuredLogger != nil {
+		fields := map[string]interface{}{"addr": p.addr}
+		if err != nil {
+			fields["error"] = err
+		}
+		b.structuredLogger(level.String(), msg, fields)
+		return
+	}
+	if b.logger == nil {
+		return
+	}
+	if err != nil {
+		b.logger("%s [%s] %s: %s", level, p.addr, msg, err)
 		return
 	}
-	b.logger("["+p.addr+"] "+format, args...)
+	b.logger("%s [%s] %s", level, p.addr, msg)
 }
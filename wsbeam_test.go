@@ -1,15 +1,35 @@
 package wsbeam
 
 import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
 )
 
 func TestBeam(t *testing.T) {
@@ -38,9 +58,7 @@ func TestBeamDisconnectedClientAreRemoved(t *testing.T) {
 	c := connect(t, s)
 
 	// Check pears size.
-	b.lock.Lock()
-	assert.Equal(t, 1, len(b.pears))
-	b.lock.Unlock()
+	assert.Equal(t, 1, b.Count())
 
 	// Close the connection.
 	c.Close()
@@ -49,9 +67,7 @@ func TestBeamDisconnectedClientAreRemoved(t *testing.T) {
 	time.Sleep(time.Second)
 
 	// Check that the connection was deleted from the server.
-	b.lock.Lock()
-	assert.Equal(t, 0, len(b.pears))
-	b.lock.Unlock()
+	assert.Equal(t, 0, b.Count())
 }
 
 // Tests send to many connected clients.
@@ -80,32 +96,3082 @@ func TestBeamMultiConnections(t *testing.T) {
 	}
 }
 
-func TestBeamNoLog(t *testing.T) {
+func TestBeamSendTo(t *testing.T) {
 	t.Parallel()
 
-	b := New(OptLogger(nil))
+	b := New(OptLogger(t.Logf))
+	s := newServer(t, b)
+	foo := connectURL(t, s, s.URL+"?topic=foo")
+	fooBar := connectURL(t, s, s.URL+"?topic=foo&topic=bar")
+	none := connect(t, s)
+
+	require.NoError(t, b.SendTo("bar", "bar"))
+	require.NoError(t, b.SendTo("foo", "foo"))
+
+	var result string
+	require.NoError(t, foo.ReadJSON(&result))
+	assert.Equal(t, "foo", result)
+
+	require.NoError(t, fooBar.ReadJSON(&result))
+	assert.Equal(t, "bar", result)
+	require.NoError(t, fooBar.ReadJSON(&result))
+	assert.Equal(t, "foo", result)
+
+	none.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, _, err := none.ReadMessage()
+	assert.Error(t, err)
+}
+
+func TestBeamSendToWildcard(t *testing.T) {
+	t.Parallel()
+
+	b := New(OptLogger(t.Logf))
+	s := newServer(t, b)
+	sensors := connectURL(t, s, s.URL+"?topic=sensors/*")
+
+	require.NoError(t, b.SendTo("sensors", "sensors"))
+	require.NoError(t, b.SendTo("sensors/temp", "temp"))
+	require.NoError(t, b.SendTo("sensors/humidity", "humidity"))
+
+	var result string
+	require.NoError(t, sensors.ReadJSON(&result))
+	assert.Equal(t, "temp", result)
+	require.NoError(t, sensors.ReadJSON(&result))
+	assert.Equal(t, "humidity", result)
+}
+
+func TestMatchTopic(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		subscription string
+		topic        string
+		want         bool
+	}{
+		{subscription: "foo", topic: "foo", want: true},
+		{subscription: "foo", topic: "foobar", want: false},
+		{subscription: "foo/*", topic: "foo/bar", want: true},
+		{subscription: "foo/*", topic: "foo/bar/baz", want: true},
+		{subscription: "foo/*", topic: "foo/", want: true},
+		{subscription: "foo/*", topic: "foo", want: false},
+		{subscription: "foo*", topic: "foobar", want: true},
+		{subscription: "a/*/*", topic: "a/*/b", want: true},
+		{subscription: "a/*/*", topic: "a/b/c", want: false},
+		{subscription: "*", topic: "foo", want: true},
+		{subscription: "*", topic: "", want: true},
+		{subscription: "", topic: "", want: true},
+		{subscription: "", topic: "foo", want: false},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, matchTopic(tt.subscription, tt.topic), "%q, %q", tt.subscription, tt.topic)
+	}
+}
+
+func TestBeamSendSample(t *testing.T) {
+	t.Parallel()
+
+	b := New(OptLogger(t.Logf))
+	s := newServer(t, b)
+	conns := []*websocket.Conn{connect(t, s), connect(t, s), connect(t, s)}
+
+	require.NoError(t, b.SendSample(0, "none"))
+	require.NoError(t, b.SendSample(1, "all"))
+	for _, c := range conns {
+		var result string
+		require.NoError(t, c.ReadJSON(&result))
+		assert.Equal(t, "all", result)
+	}
+
+	// With a seed, the selection is deterministic, monotonic in the fraction, and about the given
+	// fraction of the connections.
+	seeded := New(OptLogger(t.Logf), OptSampleSeed(42))
+	selected := 0
+	for i := 0; i < 1000; i++ {
+		p := &Client{addr: fmt.Sprintf("10.0.0.%d:1234", i)}
+		if seeded.sampled(p, 0.2) {
+			selected++
+			assert.True(t, seeded.sampled(p, 0.2))
+			assert.True(t, seeded.sampled(p, 0.5))
+		}
+	}
+	assert.InDelta(t, 200, selected, 50)
+}
+
+func TestBeamSendToTag(t *testing.T) {
+	t.Parallel()
+
+	b := New(OptLogger(t.Logf), OptTags(func(r *http.Request) []string {
+		return strings.Split(r.URL.Query().Get("tags"), ",")
+	}))
+	s := newServer(t, b)
+	premium := connectURL(t, s, s.URL+"?tags=premium,beta")
+	beta := connectURL(t, s, s.URL+"?tags=beta")
+
+	require.NoError(t, b.SendToTag("premium", "premium"))
+	require.NoError(t, b.SendToTag("beta", "beta"))
+
+	for _, want := range []string{"premium", "beta"} {
+		var result string
+		require.NoError(t, premium.ReadJSON(&result))
+		assert.Equal(t, want, result)
+	}
+	var result string
+	require.NoError(t, beta.ReadJSON(&result))
+	assert.Equal(t, "beta", result)
+}
+
+func TestBeamSendToAddr(t *testing.T) {
+	t.Parallel()
+
+	b := New(OptLogger(t.Logf))
+	s := newServer(t, b)
+	c1 := connect(t, s)
+	c2 := connect(t, s)
+
+	found, err := b.SendToAddr(c2.LocalAddr().String(), "test")
+	require.NoError(t, err)
+	assert.True(t, found)
+
+	found, err = b.SendToAddr("unknown", "test")
+	require.NoError(t, err)
+	assert.False(t, found)
+
+	var result string
+	require.NoError(t, c2.ReadJSON(&result))
+	assert.Equal(t, "test", result)
+
+	c1.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, _, err = c1.ReadMessage()
+	assert.Error(t, err)
+}
+
+func TestBeamForEach(t *testing.T) {
+	t.Parallel()
+
+	b := New(OptLogger(t.Logf))
+	s := newServer(t, b)
+	c1 := connect(t, s)
+	c2 := connect(t, s)
+
+	// The function can send to the clients.
+	var addrs []string
+	b.ForEach(func(c *Client) {
+		addrs = append(addrs, c.Addr())
+		assert.NoError(t, c.Send(c.Addr()))
+	})
+	assert.ElementsMatch(t, []string{c1.LocalAddr().String(), c2.LocalAddr().String()}, addrs)
+
+	for _, c := range []*websocket.Conn{c1, c2} {
+		var result string
+		require.NoError(t, c.ReadJSON(&result))
+		assert.Equal(t, c.LocalAddr().String(), result)
+	}
+}
+
+func TestBeamRemoteAddr(t *testing.T) {
+	t.Parallel()
+
+	lines := make(chan string, 100)
+	b := New(
+		OptLogger(func(format string, args ...interface{}) { lines <- fmt.Sprintf(format, args...) }),
+		OptRemoteAddr(func(r *http.Request) string { return r.Header.Get("X-Real-IP") }))
+	s := newServer(t, b)
+
+	c, _, err := websocket.DefaultDialer.Dial(s.URL, http.Header{"X-Real-IP": {"10.0.0.1"}})
+	require.NoError(t, err)
+	defer c.Close()
+
+	// The connection is logged with the remote address of the option.
+	assert.Equal(t, "debug [10.0.0.1] New connection", <-lines)
+
+	deadline := time.Now().Add(time.Second)
+	for len(b.Clients()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, []string{"10.0.0.1"}, b.Clients())
+
+	found, err := b.SendToAddr("10.0.0.1", "test")
+	require.NoError(t, err)
+	assert.True(t, found)
+
+	var result string
+	require.NoError(t, c.ReadJSON(&result))
+	assert.Equal(t, "test", result)
+}
+
+func TestBeamSendToMany(t *testing.T) {
+	t.Parallel()
+
+	clients := make(chan *Client, 3)
+	b := New(OptLogger(t.Logf), OptOnConnect(func(c *Client) { clients <- c }))
+	s := newServer(t, b)
+	c1 := connect(t, s)
+	c2 := connect(t, s)
+	c3 := connect(t, s)
+	var targets []*Client
+	for i := 0; i < 3; i++ {
+		if c := <-clients; c.Addr() != c3.LocalAddr().String() {
+			targets = append(targets, c)
+		}
+	}
+
+	// Duplicate clients and clients of other beams are skipped.
+	other := &Client{beam: New(OptLogger(nil))}
+	n, err := b.SendToMany(append(targets, targets[0], other), "first")
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+	require.NoError(t, b.Send("second"))
+
+	for _, c := range []*websocket.Conn{c1, c2} {
+		for _, want := range []string{"first", "second"} {
+			var result string
+			require.NoError(t, c.ReadJSON(&result))
+			assert.Equal(t, want, result)
+		}
+	}
+	var result string
+	require.NoError(t, c3.ReadJSON(&result))
+	assert.Equal(t, "second", result)
+}
+
+func TestBeamSendExcept(t *testing.T) {
+	t.Parallel()
+
+	clients := make(chan *Client, 1)
+	b := New(OptLogger(t.Logf), OptOnConnect(func(c *Client) { clients <- c }))
+	s := newServer(t, b)
+	sender := connect(t, s)
+	senderClient := <-clients
+	other := connect(t, s)
+	<-clients
+
+	require.NoError(t, b.SendExcept(senderClient, "first"))
+	require.NoError(t, b.Send("second"))
+
+	var result string
+	require.NoError(t, other.ReadJSON(&result))
+	assert.Equal(t, "first", result)
+	require.NoError(t, sender.ReadJSON(&result))
+	assert.Equal(t, "second", result)
+}
+
+func TestBeamSendFunc(t *testing.T) {
+	t.Parallel()
+
+	b := New(OptLogger(t.Logf))
+	s := newServer(t, b)
+	c1 := connect(t, s)
+	c2 := connect(t, s)
+
+	err := b.SendFunc("test", func(c *Client) bool { return c.Addr() == c2.LocalAddr().String() })
+	require.NoError(t, err)
+
+	var result string
+	require.NoError(t, c2.ReadJSON(&result))
+	assert.Equal(t, "test", result)
+
+	c1.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, _, err = c1.ReadMessage()
+	assert.Error(t, err)
+}
+
+func TestBeamSendMany(t *testing.T) {
+	t.Parallel()
+
+	b := New(OptLogger(t.Logf))
 	s := newServer(t, b)
 	c := connect(t, s)
 
-	err := b.Send("test")
+	require.NoError(t, b.SendMany([]interface{}{1, 2, 3}))
+
+	for i := 1; i <= 3; i++ {
+		var result int
+		require.NoError(t, c.ReadJSON(&result))
+		assert.Equal(t, i, result)
+	}
+}
+
+func TestBeamSendEach(t *testing.T) {
+	t.Parallel()
+
+	b := New(OptLogger(t.Logf))
+	s := newServer(t, b)
+	c1 := connect(t, s)
+	c2 := connect(t, s)
+
+	err := b.SendEach(func(c *Client) (interface{}, error) {
+		if c.Addr() == c2.LocalAddr().String() {
+			return nil, ErrSkip
+		}
+		return "hello " + c.Addr(), nil
+	})
 	require.NoError(t, err)
 
 	var result string
-	err = c.ReadJSON(&result)
+	require.NoError(t, c1.ReadJSON(&result))
+	assert.Equal(t, "hello "+c1.LocalAddr().String(), result)
+
+	c2.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, _, err = c2.ReadMessage()
+	assert.Error(t, err)
+}
+
+func TestBeamSendText(t *testing.T) {
+	t.Parallel()
+
+	b := New(OptLogger(t.Logf))
+	s := newServer(t, b)
+	c := connect(t, s)
+
+	err := b.SendText("test")
+	require.NoError(t, err)
+
+	messageType, data, err := c.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, websocket.TextMessage, messageType)
+	assert.Equal(t, "test", string(data))
+}
+
+func TestBeamMessageType(t *testing.T) {
+	t.Parallel()
+
+	b := New(OptLogger(t.Logf), OptMessageType(websocket.BinaryMessage))
+	s := newServer(t, b)
+	c := connect(t, s)
+
+	err := b.Send("test")
+	require.NoError(t, err)
+
+	messageType, data, err := c.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, websocket.BinaryMessage, messageType)
+	assert.Equal(t, `"test"`, string(data))
+
+	_, err = NewE(OptMessageType(websocket.PingMessage))
+	assert.EqualError(t, err, "invalid message type 9")
+	assert.Panics(t, func() { New(OptMessageType(websocket.PingMessage)) })
+}
+
+func TestBeamSendPrepared(t *testing.T) {
+	t.Parallel()
+
+	b1 := New(OptLogger(t.Logf))
+	b2 := New(OptLogger(t.Logf))
+	c1 := connect(t, newServer(t, b1))
+	c2 := connect(t, newServer(t, b2))
+
+	msg, err := Prepare("test")
 	require.NoError(t, err)
+	require.NoError(t, b1.SendPrepared(msg))
+	require.NoError(t, b2.SendPrepared(msg))
+
+	for _, c := range []*websocket.Conn{c1, c2} {
+		var result string
+		require.NoError(t, c.ReadJSON(&result))
+		assert.Equal(t, "test", result)
+	}
+}
+
+func TestTypedBeam(t *testing.T) {
+	t.Parallel()
+
+	type point struct{ X, Y int }
+
+	b := NewTyped[point](OptLogger(t.Logf))
+	s := newServer(t, b.Beam)
+	c := connect(t, s)
+
+	require.NoError(t, b.Send(point{X: 1, Y: 2}))
+
+	var result point
+	require.NoError(t, c.ReadJSON(&result))
+	assert.Equal(t, point{X: 1, Y: 2}, result)
+}
+
+func TestBeamSendSync(t *testing.T) {
+	t.Parallel()
+
+	// Block the serving goroutine from writing messages.
+	block := make(chan struct{})
+	b := New(OptLogger(t.Logf), OptOnConnect(func(*Client) { <-block }))
+	s := newServer(t, b)
+	c := connect(t, s)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, b.SendSync(ctx, "first"))
+
+	close(block)
+	require.NoError(t, b.SendSync(context.Background(), "second"))
+
+	for _, want := range []string{"first", "second"} {
+		var result string
+		require.NoError(t, c.ReadJSON(&result))
+		assert.Equal(t, want, result)
+	}
+}
+
+func TestBeamSendSyncRetained(t *testing.T) {
+	t.Parallel()
+
+	b := New(OptLogger(t.Logf), OptRetainLast(), OptHistory(1))
+	s := newServer(t, b)
+	c := connect(t, s)
+
+	require.NoError(t, b.SendSync(context.Background(), "test"))
+	var result string
+	require.NoError(t, c.ReadJSON(&result))
 	assert.Equal(t, "test", result)
+
+	// The stored messages don't keep the acknowledged pears.
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	assert.Nil(t, b.retained.acks)
+	for _, msg := range b.history.messages() {
+		assert.Nil(t, msg.acks)
+	}
 }
 
-func newServer(t *testing.T, b *Beam) *httptest.Server {
-	s := httptest.NewServer(b)
-	s.URL = strings.Replace(s.URL, "http", "ws", 1)
-	t.Cleanup(func() { s.Close() })
-	return s
+func TestBeamSendSyncConnecting(t *testing.T) {
+	t.Parallel()
+
+	b := New(OptLogger(t.Logf))
+	s := newServer(t, b)
+	connect(t, s)
+
+	// Connect clients while messages are sent. The clients don't read, but the messages are small
+	// enough to be written to the connection buffers.
+	var conns []*websocket.Conn
+	done := make(chan struct{})
+	defer func() {
+		<-done
+		for _, c := range conns {
+			c.Close()
+		}
+	}()
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			c, _, err := websocket.DefaultDialer.Dial(s.URL, nil)
+			if !assert.NoError(t, err) {
+				return
+			}
+			conns = append(conns, c)
+		}
+	}()
+
+	for i := 0; ; i++ {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		err := b.SendSync(ctx, i)
+		cancel()
+		require.NoError(t, err)
+	}
 }
 
-func connect(t *testing.T, s *httptest.Server) *websocket.Conn {
-	c, resp, err := websocket.DefaultDialer.Dial(s.URL, nil)
+func TestBeamPump(t *testing.T) {
+	t.Parallel()
+
+	b := New(OptLogger(t.Logf))
+	s := newServer(t, b)
+	c := connect(t, s)
+
+	ch := make(chan interface{})
+	errs := make(chan error, 1)
+	go func() { errs <- b.Pump(context.Background(), ch) }()
+	ch <- "first"
+	ch <- "second"
+	close(ch)
+	require.NoError(t, <-errs)
+
+	for _, want := range []string{"first", "second"} {
+		var result string
+		require.NoError(t, c.ReadJSON(&result))
+		assert.Equal(t, want, result)
+	}
+
+	// The pump stops when the context is cancelled.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, context.Canceled, b.Pump(ctx, make(chan interface{})))
+
+	// The pump stops when sending fails.
+	b.Close()
+	ch = make(chan interface{}, 1)
+	ch <- "third"
+	assert.Equal(t, ErrClosed, b.Pump(context.Background(), ch))
+}
+
+func TestBeamSendBytes(t *testing.T) {
+	t.Parallel()
+
+	b := New(OptLogger(t.Logf))
+	s := newServer(t, b)
+	c := connect(t, s)
+
+	err := b.SendBytes([]byte{0, 1, 2}, websocket.BinaryMessage)
 	require.NoError(t, err)
-	require.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
-	return c
+
+	messageType, data, err := c.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, websocket.BinaryMessage, messageType)
+	assert.Equal(t, []byte{0, 1, 2}, data)
+}
+
+func TestBeamSendAuto(t *testing.T) {
+	t.Parallel()
+
+	b := New(OptLogger(t.Logf))
+	s := newServer(t, b)
+	c := connect(t, s)
+
+	require.NoError(t, b.SendAuto([]byte("héllo")))
+	require.NoError(t, b.SendAuto([]byte{0xff, 0xfe}))
+
+	messageType, data, err := c.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, websocket.TextMessage, messageType)
+	assert.Equal(t, "héllo", string(data))
+
+	messageType, data, err = c.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, websocket.BinaryMessage, messageType)
+	assert.Equal(t, []byte{0xff, 0xfe}, data)
+}
+
+func TestBeamSendTyped(t *testing.T) {
+	t.Parallel()
+
+	b := New(OptLogger(t.Logf))
+	s := newServer(t, b)
+	c := connect(t, s)
+
+	require.NoError(t, b.SendTyped(websocket.BinaryMessage, "media"))
+	require.NoError(t, b.SendTyped(websocket.TextMessage, "metadata"))
+	assert.Error(t, b.SendTyped(websocket.PingMessage, "invalid"))
+
+	for _, want := range []struct {
+		messageType int
+		data        string
+	}{
+		{websocket.BinaryMessage, `"media"`},
+		{websocket.TextMessage, `"metadata"`},
+	} {
+		messageType, data, err := c.ReadMessage()
+		require.NoError(t, err)
+		assert.Equal(t, want.messageType, messageType)
+		assert.Equal(t, want.data, string(data))
+	}
+}
+
+func TestBeamErrors(t *testing.T) {
+	t.Parallel()
+
+	// Retaining the last message makes the beam marshal messages without connections.
+	b := New(OptLogger(t.Logf), OptRetainLast())
+
+	err := b.Send(func() {})
+	assert.True(t, errors.Is(err, ErrMarshal), "got: %v", err)
+	var unsupported *json.UnsupportedTypeError
+	assert.True(t, errors.As(err, &unsupported), "got: %v", err)
+	var marshalErr *MarshalError
+	require.True(t, errors.As(err, &marshalErr), "got: %v", err)
+	assert.NotNil(t, marshalErr.Data)
+
+	err = b.SendTyped(websocket.PingMessage, "test")
+	assert.True(t, errors.Is(err, ErrPrepare), "got: %v", err)
+
+	encoded := New(
+		OptLogger(t.Logf),
+		OptRetainLast(),
+		OptEncoder(func(interface{}) ([]byte, int, error) { return nil, 0, errors.New("encoder error") }))
+	err = encoded.Send("test")
+	assert.True(t, errors.Is(err, ErrMarshal), "got: %v", err)
+	assert.Contains(t, err.Error(), "encoder error")
+	require.True(t, errors.As(err, &marshalErr), "got: %v", err)
+	assert.Equal(t, "test", marshalErr.Data)
+
+	require.NoError(t, b.Close())
+	assert.True(t, errors.Is(b.Send("test"), ErrClosed))
+}
+
+func TestBeamGzipPayload(t *testing.T) {
+	t.Parallel()
+
+	b := New(OptLogger(t.Logf), OptGzipPayload())
+	s := newServer(t, b)
+	c := connect(t, s)
+
+	require.NoError(t, b.Send("test"))
+
+	messageType, data, err := c.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, websocket.BinaryMessage, messageType)
+	assert.Equal(t, []byte{0x1f, 0x8b}, data[:2])
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	require.NoError(t, err)
+	payload, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, `"test"`, string(payload))
+}
+
+func TestBeamSendStream(t *testing.T) {
+	t.Parallel()
+
+	b := New(OptLogger(t.Logf))
+	s := newServer(t, b)
+	c := connect(t, s)
+
+	err := b.SendStream(258, []byte{0, 1, 2})
+	require.NoError(t, err)
+
+	messageType, data, err := c.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, websocket.BinaryMessage, messageType)
+	assert.Equal(t, []byte{0, 0, 1, 2, 0, 1, 2}, data)
+}
+
+func TestBeamSendContext(t *testing.T) {
+	t.Parallel()
+
+	b := New(OptLogger(t.Logf))
+	s := newServer(t, b)
+	c := connect(t, s)
+
+	err := b.SendContext(context.Background(), "test")
+	require.NoError(t, err)
+
+	var result string
+	err = c.ReadJSON(&result)
+	require.NoError(t, err)
+	assert.Equal(t, "test", result)
+
+	// Message should not be sent with a canceled context.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = b.SendContext(ctx, "canceled")
+	assert.Equal(t, context.Canceled, err)
+
+	c.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, _, err = c.ReadMessage()
+	assert.Error(t, err)
+}
+
+func TestBeamSendWait(t *testing.T) {
+	t.Parallel()
+	const count = 10
+
+	b := New(OptLogger(t.Logf), OptBuffer(1))
+	s := newServer(t, b)
+	c := connect(t, s)
+
+	// Send more messages than the buffer can hold, none of them should be discarded.
+	go func() {
+		for i := 0; i < count; i++ {
+			assert.NoError(t, b.SendWait(i))
+		}
+	}()
+
+	for i := 0; i < count; i++ {
+		var result int
+		err := c.ReadJSON(&result)
+		require.NoError(t, err)
+		assert.Equal(t, i, result)
+	}
+}
+
+func TestBeamOnDrop(t *testing.T) {
+	t.Parallel()
+
+	// Block the serving goroutine from reading messages from the buffer.
+	block := make(chan struct{})
+	defer close(block)
+
+	var dropped []interface{}
+	b := New(
+		OptLogger(t.Logf),
+		OptBuffer(1),
+		OptOnConnect(func(*Client) { <-block }),
+		OptOnDrop(func(c *Client, data interface{}) { dropped = append(dropped, data) }))
+	s := newServer(t, b)
+	connect(t, s)
+
+	require.NoError(t, b.Send("first"))
+	require.NoError(t, b.Send("second"))
+	assert.Equal(t, []interface{}{"second"}, dropped)
+}
+
+func TestBeamSendEachOnDrop(t *testing.T) {
+	t.Parallel()
+
+	// Block the serving goroutine from reading messages from the buffer.
+	block := make(chan struct{})
+	defer close(block)
+
+	var dropped []interface{}
+	b := New(
+		OptLogger(t.Logf),
+		OptBuffer(1),
+		OptOnConnect(func(*Client) { <-block }),
+		OptOnDrop(func(c *Client, data interface{}) { dropped = append(dropped, data) }))
+	s := newServer(t, b)
+	connect(t, s)
+
+	for _, data := range []string{"first", "second"} {
+		require.NoError(t, b.SendEach(func(c *Client) (interface{}, error) { return data, nil }))
+	}
+	assert.Equal(t, []interface{}{"second"}, dropped)
+	assert.Equal(t, uint64(1), b.Stats().TotalDropped)
+}
+
+func TestBeamSendDetailed(t *testing.T) {
+	t.Parallel()
+
+	// Block the serving goroutine of the first connection from reading messages from the buffer.
+	block := make(chan struct{})
+	defer close(block)
+	blocks := make(chan chan struct{}, 1)
+	blocks <- block
+	started := make(chan struct{})
+
+	b := New(
+		OptLogger(t.Logf),
+		OptBuffer(1),
+		OptOnConnect(func(*Client) {
+			select {
+			case block := <-blocks:
+				close(started)
+				<-block
+			default:
+			}
+		}))
+	s := newServer(t, b)
+	slow := connect(t, s)
+	<-started
+	fast := connect(t, s)
+
+	require.NoError(t, b.Send("first"))
+	var result string
+	require.NoError(t, fast.ReadJSON(&result))
+
+	results, err := b.SendDetailed("second")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]error{
+		slow.LocalAddr().String(): ErrBufferFull,
+		fast.LocalAddr().String(): nil,
+	}, results)
+
+	_, err = b.SendDetailed(func() {})
+	assert.Error(t, err)
+}
+
+func TestBeamOnRecover(t *testing.T) {
+	t.Parallel()
+
+	// Block the serving goroutine from reading messages from the buffer.
+	block := make(chan struct{})
+
+	recovered := make(chan *Client, 1)
+	b := New(
+		OptLogger(t.Logf),
+		OptBuffer(4),
+		OptOnConnect(func(*Client) { <-block }),
+		OptOnRecover(func(c *Client) { recovered <- c }))
+	s := newServer(t, b)
+	c := connect(t, s)
+
+	for i := 0; i < 5; i++ {
+		require.NoError(t, b.Send(i))
+	}
+	assert.Equal(t, uint64(1), b.Stats().TotalDropped)
+
+	// The function is called when the buffer drains to half of its size.
+	close(block)
+	for i := 0; i < 4; i++ {
+		var result int
+		require.NoError(t, c.ReadJSON(&result))
+		assert.Equal(t, i, result)
+	}
+	select {
+	case p := <-recovered:
+		assert.Equal(t, c.LocalAddr().String(), p.Addr())
+	case <-time.After(time.Second):
+		t.Fatal("recover function was not called")
+	}
+	select {
+	case <-recovered:
+		t.Fatal("recover function was called more than once")
+	default:
+	}
+}
+
+func TestBeamOverflowPolicy(t *testing.T) {
+	t.Parallel()
+
+	// Block the serving goroutine from reading messages from the buffer.
+	block := make(chan struct{})
+
+	var dropped []interface{}
+	b := New(
+		OptLogger(t.Logf),
+		OptBuffer(2),
+		OptOverflowPolicy(DropOldest),
+		OptOnConnect(func(*Client) { <-block }),
+		OptOnDrop(func(c *Client, data interface{}) { dropped = append(dropped, data) }))
+	s := newServer(t, b)
+	c := connect(t, s)
+
+	for i := 1; i <= 4; i++ {
+		require.NoError(t, b.Send(i))
+	}
+	assert.Equal(t, []interface{}{3, 4}, dropped)
+	assert.Equal(t, uint64(2), b.Stats().TotalDropped)
+
+	// The client gets the freshest messages.
+	close(block)
+	for _, want := range []int{3, 4} {
+		var result int
+		require.NoError(t, c.ReadJSON(&result))
+		assert.Equal(t, want, result)
+	}
+}
+
+func TestBeamMaxBufferedBytes(t *testing.T) {
+	t.Parallel()
+
+	// Block the serving goroutine from reading messages from the buffer.
+	block := make(chan struct{})
+
+	b := New(
+		OptLogger(t.Logf),
+		OptBuffer(10),
+		OptMaxBufferedBytes(10),
+		OptOnConnect(func(*Client) { <-block }))
+	s := newServer(t, b)
+	c := connect(t, s)
+
+	// Every message is encoded to 6 bytes, so only the first message fits.
+	require.NoError(t, b.Send("aaaa"))
+	require.NoError(t, b.Send("bbbb"))
+	assert.Equal(t, uint64(1), b.Stats().TotalDropped)
+	assert.Equal(t, int64(6), b.Stats().BufferedBytes)
+
+	close(block)
+	var result string
+	require.NoError(t, c.ReadJSON(&result))
+	assert.Equal(t, "aaaa", result)
+
+	// The written message no longer counts.
+	deadline := time.Now().Add(time.Second)
+	for b.Stats().BufferedBytes != 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, int64(0), b.Stats().BufferedBytes)
+}
+
+func TestBeamParallelSend(t *testing.T) {
+	t.Parallel()
+
+	const (
+		clients  = 8
+		messages = 20
+	)
+
+	b := New(OptLogger(t.Logf), OptBuffer(4), OptParallelSend(4))
+	s := newServer(t, b)
+	conns := make([]*websocket.Conn, clients)
+	for i := range conns {
+		conns[i] = connect(t, s)
+	}
+
+	go func() {
+		for i := 0; i < messages; i++ {
+			var err error
+			switch i % 3 {
+			case 0:
+				err = b.Send(i)
+			case 1:
+				err = b.SendWait(i)
+			case 2:
+				err = b.SendSync(context.Background(), i)
+			}
+			assert.NoError(t, err)
+		}
+	}()
+
+	// Every client gets the messages in order. Messages that are sent with Send or SendSync may be
+	// dropped, so the clients read until the last message, which is sent with SendWait.
+	for _, c := range conns {
+		last := -1
+		for last < messages-1 {
+			var result int
+			require.NoError(t, c.ReadJSON(&result))
+			assert.Greater(t, result, last)
+			last = result
+		}
+	}
+}
+
+func TestBeamClientCompressed(t *testing.T) {
+	t.Parallel()
+
+	clients := make(chan *Client, 1)
+	b := New(
+		OptLogger(t.Logf),
+		OptCompression(flate.BestSpeed),
+		OptOnConnect(func(c *Client) { clients <- c }))
+	s := newServer(t, b)
+
+	for _, compression := range []bool{true, false} {
+		dialer := websocket.Dialer{EnableCompression: compression}
+		c, _, err := dialer.Dial(s.URL, nil)
+		require.NoError(t, err)
+		defer c.Close()
+		assert.Equal(t, compression, (<-clients).Compressed())
+	}
+}
+
+func TestBeamOverflowPolicySync(t *testing.T) {
+	t.Parallel()
+
+	// Block the serving goroutine from reading messages from the buffer.
+	block := make(chan struct{})
+
+	b := New(
+		OptLogger(t.Logf),
+		OptBuffer(1),
+		OptOverflowPolicy(DropOldest),
+		OptOnConnect(func(*Client) { <-block }))
+	s := newServer(t, b)
+	c := connect(t, s)
+
+	errs := make(chan error, 1)
+	go func() { errs <- b.SendSync(context.Background(), "first") }()
+	// Wait until the message is buffered.
+	deadline := time.Now().Add(time.Second)
+	for b.Pressure() < 1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	// Evicting the message releases SendSync, and the new message is delivered.
+	delivered, dropped, err := b.SendReport("second")
+	require.NoError(t, err)
+	assert.Equal(t, 1, delivered)
+	assert.Equal(t, 1, dropped)
+	select {
+	case err := <-errs:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("SendSync did not return")
+	}
+
+	results, err := b.SendDetailed("third")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]error{c.LocalAddr().String(): nil}, results)
+	assert.Equal(t, uint64(2), b.Stats().TotalDropped)
+
+	close(block)
+	var result string
+	require.NoError(t, c.ReadJSON(&result))
+	assert.Equal(t, "third", result)
+}
+
+func TestBeamCompression(t *testing.T) {
+	t.Parallel()
+
+	b := New(OptLogger(t.Logf), OptCompression(flate.BestCompression))
+	s := newServer(t, b)
+
+	dialer := websocket.Dialer{EnableCompression: true}
+	c, resp, err := dialer.Dial(s.URL, nil)
+	require.NoError(t, err)
+	defer c.Close()
+	assert.Contains(t, resp.Header.Get("Sec-Websocket-Extensions"), "permessage-deflate")
+	waitAdded(t, s, c)
+
+	err = b.Send(strings.Repeat("test", 100))
+	require.NoError(t, err)
+
+	var result string
+	err = c.ReadJSON(&result)
+	require.NoError(t, err)
+	assert.Equal(t, strings.Repeat("test", 100), result)
+}
+
+func TestBeamPressure(t *testing.T) {
+	t.Parallel()
+
+	// Block the serving goroutine from reading messages from the buffer.
+	block := make(chan struct{})
+	defer close(block)
+
+	b := New(OptLogger(t.Logf), OptBuffer(4), OptOnConnect(func(*Client) { <-block }))
+	s := newServer(t, b)
+	assert.Equal(t, 0.0, b.Pressure())
+	connect(t, s)
+	assert.Equal(t, 0.0, b.Pressure())
+
+	require.NoError(t, b.Send("first"))
+	assert.Equal(t, 0.25, b.Pressure())
+	for i := 0; i < 4; i++ {
+		require.NoError(t, b.Send(i))
+	}
+	assert.Equal(t, 1.0, b.Pressure())
+}
+
+func TestBeamSequence(t *testing.T) {
+	t.Parallel()
+
+	b := New(OptLogger(t.Logf), OptSequence())
+	s := newServer(t, b)
+	c := connect(t, s)
+
+	require.NoError(t, b.Send("first"))
+	require.NoError(t, b.SendTo("topic", "ignored"))
+	require.NoError(t, b.SendFunc("targeted", func(*Client) bool { return true }))
+	require.NoError(t, b.SendMany([]interface{}{"second", "third"}))
+
+	for _, want := range []string{
+		`{"seq":1,"data":"first"}`,
+		`{"seq":0,"data":"targeted"}`,
+		`{"seq":2,"data":"second"}`,
+		`{"seq":3,"data":"third"}`,
+	} {
+		_, data, err := c.ReadMessage()
+		require.NoError(t, err)
+		assert.Equal(t, want, string(data))
+	}
+}
+
+func TestBeamSendFrom(t *testing.T) {
+	t.Parallel()
+
+	acked := make(chan struct{}, 1)
+	b := New(OptLogger(t.Logf), OptOnMessage(func(c *Client, _ int, data []byte) {
+		seq, err := strconv.ParseUint(string(data), 10, 64)
+		require.NoError(t, err)
+		c.Ack(seq)
+		acked <- struct{}{}
+	}))
+	s := newServer(t, b)
+	ahead := connect(t, s)
+	behind := connect(t, s)
+
+	require.NoError(t, ahead.WriteMessage(websocket.TextMessage, []byte("5")))
+	<-acked
+	require.NoError(t, behind.WriteMessage(websocket.TextMessage, []byte("2")))
+	<-acked
+
+	for seq := uint64(3); seq <= 6; seq++ {
+		require.NoError(t, b.SendFrom(seq, seq))
+	}
+
+	for _, want := range []string{`{"seq":3,"data":3}`, `{"seq":4,"data":4}`, `{"seq":5,"data":5}`, `{"seq":6,"data":6}`} {
+		_, data, err := behind.ReadMessage()
+		require.NoError(t, err)
+		assert.Equal(t, want, string(data))
+	}
+	_, data, err := ahead.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, `{"seq":6,"data":6}`, string(data))
+}
+
+func TestBeamDedupe(t *testing.T) {
+	t.Parallel()
+
+	b := New(OptLogger(t.Logf), OptDedupe(), OptSequence())
+	s := newServer(t, b)
+	c := connect(t, s)
+
+	require.NoError(t, b.Send("first"))
+	assert.Equal(t, ErrDuplicate, b.Send("first"))
+	require.NoError(t, b.SendMany([]interface{}{"first", "second", "second", "first"}))
+	assert.Equal(t, ErrDuplicate, b.SendMany([]interface{}{"first"}))
+
+	for _, want := range []string{
+		`{"seq":1,"data":"first"}`,
+		`{"seq":2,"data":"second"}`,
+		`{"seq":3,"data":"first"}`,
+	} {
+		_, data, err := c.ReadMessage()
+		require.NoError(t, err)
+		assert.Equal(t, want, string(data))
+	}
+}
+
+func TestBeamDedupePaused(t *testing.T) {
+	t.Parallel()
+
+	b := New(OptLogger(t.Logf), OptDedupe())
+	s := newServer(t, b)
+	c := connect(t, s)
+
+	// A message that was sent while the beam was paused is not the previous message.
+	b.Pause()
+	require.NoError(t, b.Send("first"))
+	b.Resume()
+	require.NoError(t, b.Send("first"))
+
+	var result string
+	require.NoError(t, c.ReadJSON(&result))
+	assert.Equal(t, "first", result)
+}
+
+func TestBeamHistory(t *testing.T) {
+	t.Parallel()
+
+	b := New(OptLogger(t.Logf), OptHistory(2))
+	s := newServer(t, b)
+
+	for i := 1; i <= 3; i++ {
+		require.NoError(t, b.Send(i))
+	}
+	// Messages that are not sent to all the connections are not kept.
+	require.NoError(t, b.SendTo("topic", 0))
+
+	replay := connectURL(t, s, s.URL+"?replay=1")
+	live := connect(t, s)
+	require.NoError(t, b.Send(4))
+
+	for _, want := range []int{2, 3, 4} {
+		var result int
+		require.NoError(t, replay.ReadJSON(&result))
+		assert.Equal(t, want, result)
+	}
+	var result int
+	require.NoError(t, live.ReadJSON(&result))
+	assert.Equal(t, 4, result)
+}
+
+func TestClientQueue(t *testing.T) {
+	t.Parallel()
+
+	// Block the serving goroutine from reading messages from the buffer.
+	block := make(chan struct{})
+	defer close(block)
+
+	clients := make(chan *Client, 1)
+	b := New(OptLogger(t.Logf), OptBuffer(4), OptOnConnect(func(c *Client) {
+		clients <- c
+		<-block
+	}))
+	s := newServer(t, b)
+	connect(t, s)
+	c := <-clients
+
+	assert.Equal(t, 0, c.QueueLen())
+	assert.Equal(t, 4, c.QueueCap())
+	require.NoError(t, b.Send("first"))
+	require.NoError(t, b.Send("second"))
+	assert.Equal(t, 2, c.QueueLen())
+}
+
+func TestClientTLS(t *testing.T) {
+	t.Parallel()
+
+	// Create a self signed client certificate.
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "client"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(cert)
+
+	names := make(chan string, 2)
+	b := New(OptLogger(t.Logf), OptOnConnect(func(c *Client) {
+		assert.NotNil(t, c.TLS())
+		names <- c.PeerCommonName()
+	}))
+	th := &testHandler{beam: b, handler: b}
+	s := httptest.NewUnstartedServer(th)
+	s.TLS = &tls.Config{ClientAuth: tls.VerifyClientCertIfGiven, ClientCAs: clientCAs}
+	s.StartTLS()
+	t.Cleanup(func() {
+		b.Close()
+		th.wg.Wait()
+		s.Close()
+	})
+	url := strings.Replace(s.URL, "https", "wss", 1)
+
+	rootCAs := s.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+	dialer := websocket.Dialer{TLSClientConfig: &tls.Config{
+		RootCAs:      rootCAs,
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	}}
+	c, _, err := dialer.Dial(url, nil)
+	require.NoError(t, err)
+	defer c.Close()
+	assert.Equal(t, "client", <-names)
+
+	// Without a client certificate.
+	dialer = websocket.Dialer{TLSClientConfig: &tls.Config{RootCAs: rootCAs}}
+	c, _, err = dialer.Dial(url, nil)
+	require.NoError(t, err)
+	defer c.Close()
+	assert.Equal(t, "", <-names)
+}
+
+func TestBeamHandshakeTimeout(t *testing.T) {
+	t.Parallel()
+
+	// The option applies regardless of the upgrader option order.
+	b := New(OptLogger(t.Logf), OptHandshakeTimeout(time.Second), OptUpgrader(websocket.Upgrader{}))
+	assert.Equal(t, time.Second, b.upgrader.HandshakeTimeout)
+
+	s := newServer(t, b)
+	connect(t, s)
+}
+
+func TestClientConn(t *testing.T) {
+	t.Parallel()
+
+	addrs := make(chan string, 1)
+	b := New(OptLogger(t.Logf), OptOnConnect(func(c *Client) { addrs <- c.Conn().RemoteAddr().String() }))
+	s := newServer(t, b)
+	c := connect(t, s)
+	assert.Equal(t, c.LocalAddr().String(), <-addrs)
+}
+
+func TestBeamSubprotocols(t *testing.T) {
+	t.Parallel()
+
+	protos := make(chan string, 2)
+	b := New(
+		OptLogger(t.Logf),
+		OptSubprotocols("v2", "v1"),
+		OptOnConnect(func(c *Client) { protos <- c.Subprotocol() }))
+	s := newServer(t, b)
+
+	dialer := websocket.Dialer{Subprotocols: []string{"v1", "v2"}}
+	c, _, err := dialer.Dial(s.URL, nil)
+	require.NoError(t, err)
+	defer c.Close()
+	assert.Equal(t, "v2", c.Subprotocol())
+	assert.Equal(t, "v2", <-protos)
+
+	// Clients without a supported subprotocol are connected without a subprotocol.
+	c = connect(t, s)
+	assert.Equal(t, "", c.Subprotocol())
+	assert.Equal(t, "", <-protos)
+}
+
+func TestBeamCompressionThreshold(t *testing.T) {
+	t.Parallel()
+
+	b := New(OptLogger(t.Logf), OptCompression(flate.BestSpeed), OptCompressionThreshold(100))
+	s := newServer(t, b)
+
+	// Record the raw frames that the client reads, to check their compression bit.
+	var conn *recordConn
+	dialer := websocket.Dialer{
+		EnableCompression: true,
+		NetDial: func(network, addr string) (net.Conn, error) {
+			c, err := net.Dial(network, addr)
+			conn = &recordConn{Conn: c}
+			return conn, err
+		},
+	}
+	c, _, err := dialer.Dial(s.URL, nil)
+	require.NoError(t, err)
+	defer c.Close()
+	waitAdded(t, s, c)
+
+	for _, tt := range []struct {
+		data       string
+		compressed bool
+	}{
+		{data: "short", compressed: false},
+		{data: strings.Repeat("long", 100), compressed: true},
+	} {
+		conn.read = nil
+		require.NoError(t, b.Send(tt.data))
+		var result string
+		require.NoError(t, c.ReadJSON(&result))
+		assert.Equal(t, tt.data, result)
+		// The RSV1 bit of the first frame byte is set for compressed messages.
+		require.NotEmpty(t, conn.read)
+		assert.Equal(t, tt.compressed, conn.read[0]&0x40 != 0)
+	}
+}
+
+// recordConn records the data that is read from a connection.
+type recordConn struct {
+	net.Conn
+	read []byte
+}
+
+func (c *recordConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.read = append(c.read, p[:n]...)
+	return n, err
+}
+
+func TestBeamSendReport(t *testing.T) {
+	t.Parallel()
+
+	// Block the serving goroutine from reading messages from the buffer.
+	block := make(chan struct{})
+	defer close(block)
+
+	b := New(OptLogger(t.Logf), OptBuffer(1), OptOnConnect(func(*Client) { <-block }))
+	s := newServer(t, b)
+	connect(t, s)
+	connect(t, s)
+
+	delivered, dropped, err := b.SendReport("first")
+	require.NoError(t, err)
+	assert.Equal(t, 2, delivered)
+	assert.Equal(t, 0, dropped)
+
+	delivered, dropped, err = b.SendReport("second")
+	require.NoError(t, err)
+	assert.Equal(t, 0, delivered)
+	assert.Equal(t, 2, dropped)
+}
+
+func TestBeamBufferFunc(t *testing.T) {
+	t.Parallel()
+
+	// Block the serving goroutine from reading messages from the buffer.
+	block := make(chan struct{})
+	defer close(block)
+
+	b := New(
+		OptLogger(t.Logf),
+		OptBuffer(1),
+		OptBufferFunc(func(r *http.Request) int {
+			n, err := strconv.Atoi(r.URL.Query().Get("buffer"))
+			if err != nil {
+				return -1
+			}
+			return n
+		}),
+		OptOnConnect(func(*Client) { <-block }))
+	s := newServer(t, b)
+	connect(t, s)
+	connectURL(t, s, s.URL+"?buffer=2")
+
+	for _, want := range []struct{ delivered, dropped int }{{2, 0}, {1, 1}, {0, 2}} {
+		delivered, dropped, err := b.SendReport("test")
+		require.NoError(t, err)
+		assert.Equal(t, want.delivered, delivered)
+		assert.Equal(t, want.dropped, dropped)
+	}
+}
+
+func TestBeamDynamicBuffer(t *testing.T) {
+	t.Parallel()
+
+	// Block the serving goroutine from reading messages from the buffer.
+	block := make(chan struct{})
+	b := New(OptLogger(t.Logf), OptDynamicBuffer(1, 4), OptOnConnect(func(*Client) { <-block }))
+	s := newServer(t, b)
+	c := connect(t, s)
+
+	// The buffer should grow up to its maximum size before messages are discarded.
+	for i := 0; i < 5; i++ {
+		delivered, dropped, err := b.SendReport(i)
+		require.NoError(t, err)
+		if i < 4 {
+			assert.Equal(t, 1, delivered)
+		} else {
+			assert.Equal(t, 1, dropped)
+		}
+	}
+
+	close(block)
+	for i := 0; i < 4; i++ {
+		var result int
+		require.NoError(t, c.ReadJSON(&result))
+		assert.Equal(t, i, result)
+	}
+}
+
+func TestBeamCount(t *testing.T) {
+	t.Parallel()
+	const count = 10
+
+	b := New(OptLogger(t.Logf))
+	s := newServer(t, b)
+
+	assert.Equal(t, 0, b.Count())
+
+	for i := 0; i < count; i++ {
+		connect(t, s)
+	}
+
+	assert.Equal(t, count, b.Count())
+}
+
+func TestBeamClients(t *testing.T) {
+	t.Parallel()
+
+	b := New(OptLogger(t.Logf))
+	s := newServer(t, b)
+
+	assert.Empty(t, b.Clients())
+
+	c1 := connect(t, s)
+	c2 := connect(t, s)
+
+	want := []string{c1.LocalAddr().String(), c2.LocalAddr().String()}
+	assert.ElementsMatch(t, want, b.Clients())
+}
+
+func TestClientSend(t *testing.T) {
+	t.Parallel()
+
+	b := New(OptLogger(t.Logf))
+	s := newServer(t, b)
+	c1 := connect(t, s)
+	c2 := connect(t, s)
+
+	// Get the server side handle of the first connection.
+	var client *Client
+	b.each(func(p *Client) bool {
+		if p.Addr() == c1.LocalAddr().String() {
+			client = p
+		}
+		return true
+	})
+	require.NotNil(t, client)
+
+	err := client.Send("test")
+	require.NoError(t, err)
+
+	var result string
+	err = c1.ReadJSON(&result)
+	require.NoError(t, err)
+	assert.Equal(t, "test", result)
+
+	// The second connection should not get the message.
+	c2.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, _, err = c2.ReadMessage()
+	assert.Error(t, err)
+
+	// After the beam is closed, the client is disconnected.
+	require.NoError(t, b.Close())
+	assert.Equal(t, ErrDisconnected, client.Send("test"))
+}
+
+func TestClientConnected(t *testing.T) {
+	t.Parallel()
+
+	clients := make(chan *Client, 1)
+	b := New(OptLogger(t.Logf), OptOnConnect(func(c *Client) { clients <- c }))
+	s := newServer(t, b)
+	c := connect(t, s)
+
+	client := <-clients
+	assert.True(t, client.Connected())
+
+	// After the connection is closed, the client should not be connected.
+	c.Close()
+	deadline := time.Now().Add(time.Second)
+	for client.Connected() {
+		if time.Now().After(deadline) {
+			t.Fatal("Client is still connected")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestBeamOnConnect(t *testing.T) {
+	t.Parallel()
+
+	b := New(
+		OptLogger(t.Logf),
+		OptOnConnect(func(c *Client) {
+			require.NoError(t, c.Send("welcome "+c.Addr()))
+		}))
+	s := newServer(t, b)
+	c := connect(t, s)
+
+	var result string
+	err := c.ReadJSON(&result)
+	require.NoError(t, err)
+	assert.Equal(t, "welcome "+c.LocalAddr().String(), result)
+}
+
+func TestBeamOnDisconnect(t *testing.T) {
+	t.Parallel()
+
+	reasons := make(chan error, 1)
+	b := New(
+		OptLogger(t.Logf),
+		OptOnDisconnect(func(c *Client, reason error) { reasons <- reason }))
+	s := newServer(t, b)
+
+	// Client closes the connection cleanly.
+	c := connect(t, s)
+	err := c.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	require.NoError(t, err)
+	assert.NoError(t, <-reasons)
+
+	// Beam is closed.
+	c = connect(t, s)
+	require.NoError(t, b.Close())
+	_, _, err = c.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseGoingAway), "got: %v", err)
+	assert.Equal(t, ErrClosed, <-reasons)
+}
+
+func TestBeamDisconnectDetection(t *testing.T) {
+	t.Parallel()
+
+	for name, mode := range map[string]DisconnectDetection{"ping only": DetectPingOnly, "none": DetectNone} {
+		mode := mode
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			b := New(
+				OptLogger(t.Logf),
+				OptPingInterval(20*time.Millisecond),
+				OptDisconnectDetection(mode),
+				OptOnMessage(func(*Client, int, []byte) { t.Error("Unexpected read") }))
+			s := newServer(t, b)
+			c := connect(t, s)
+
+			require.NoError(t, c.WriteMessage(websocket.TextMessage, []byte("ignored")))
+			require.NoError(t, b.Send("test"))
+			var result string
+			require.NoError(t, c.ReadJSON(&result))
+			assert.Equal(t, "test", result)
+
+			// Without reading, a closed connection is detected only by failing writes.
+			c.Close()
+			deadline := time.Now().Add(time.Second)
+			for b.Count() != 0 {
+				if time.Now().After(deadline) {
+					t.Fatal("Connection was not removed")
+				}
+				if mode == DetectNone {
+					b.Send("test")
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		})
+	}
+}
+
+func TestBeamPingInterval(t *testing.T) {
+	t.Parallel()
+
+	b := New(OptLogger(t.Logf), OptPingInterval(50*time.Millisecond))
+	s := newServer(t, b)
+
+	// A client that reads messages responds to pings.
+	alive := connect(t, s)
+	go func() {
+		for {
+			if _, _, err := alive.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	// A client that does not read messages does not respond to pings.
+	connect(t, s)
+
+	assert.Equal(t, 2, b.Count())
+
+	// Give server time to detect the dead connection.
+	time.Sleep(500 * time.Millisecond)
+
+	assert.Equal(t, 1, b.Count())
+}
+
+func TestBeamWriteTimeout(t *testing.T) {
+	t.Parallel()
+
+	b := New(OptLogger(t.Logf), OptWriteTimeout(100*time.Millisecond))
+	s := newServer(t, b)
+
+	// A client that does not read messages.
+	connect(t, s)
+
+	// Send large messages to fill the connection buffers.
+	data := make([]byte, 1<<20)
+	for i := 0; i < 50; i++ {
+		require.NoError(t, b.SendBytes(data, websocket.BinaryMessage))
+	}
+
+	// Give server time to detect the stuck connection.
+	time.Sleep(time.Second)
+
+	assert.Equal(t, 0, b.Count())
+}
+
+func TestBeamConnectMetadata(t *testing.T) {
+	t.Parallel()
+
+	b := New(
+		OptLogger(t.Logf),
+		OptConnectMetadata(func(r *http.Request) (map[string]interface{}, error) {
+			user := r.URL.Query().Get("user")
+			if user == "" {
+				return nil, errors.New("missing user")
+			}
+			return map[string]interface{}{"user": user}, nil
+		}))
+	s := newServer(t, b)
+
+	// Unauthenticated connections are rejected.
+	_, resp, err := websocket.DefaultDialer.Dial(s.URL, nil)
+	require.Error(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Equal(t, 0, b.Count())
+
+	c1 := connectURL(t, s, s.URL+"?user=a")
+	c2 := connectURL(t, s, s.URL+"?user=b")
+
+	err = b.SendFunc("test", func(c *Client) bool { return c.Metadata()["user"] == "b" })
+	require.NoError(t, err)
+
+	var result string
+	require.NoError(t, c2.ReadJSON(&result))
+	assert.Equal(t, "test", result)
+
+	c1.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, _, err = c1.ReadMessage()
+	assert.Error(t, err)
+}
+
+func TestBeamOnMessage(t *testing.T) {
+	t.Parallel()
+
+	b := New(
+		OptLogger(t.Logf),
+		OptOnMessage(func(c *Client, messageType int, data []byte) {
+			assert.Equal(t, websocket.TextMessage, messageType)
+			assert.NoError(t, c.Send("got "+string(data)))
+		}))
+	s := newServer(t, b)
+	c := connect(t, s)
+
+	require.NoError(t, c.WriteMessage(websocket.TextMessage, []byte("ping")))
+
+	var result string
+	require.NoError(t, c.ReadJSON(&result))
+	assert.Equal(t, "got ping", result)
+}
+
+func TestBeamOnRequest(t *testing.T) {
+	t.Parallel()
+
+	errs := make(chan error, 2)
+	b := New(
+		OptLogger(t.Logf),
+		OptOnError(func(c *Client, err error) {
+			select {
+			case errs <- err:
+			default:
+			}
+		}),
+		OptOnRequest(func(c *Client, messageType int, data []byte) (interface{}, error) {
+			switch string(data) {
+			case "fail":
+				return nil, errors.New("failed")
+			case "unmarshalable":
+				return func() {}, nil
+			case "ignore":
+				return nil, nil
+			}
+			return "got " + string(data), nil
+		}))
+	s := newServer(t, b)
+	c := connect(t, s)
+	other := connect(t, s)
+
+	for _, msg := range []string{"fail", "unmarshalable", "ignore", "ping"} {
+		require.NoError(t, c.WriteMessage(websocket.TextMessage, []byte(msg)))
+	}
+
+	// Failures are reported, and only the reply is sent to the client.
+	assert.EqualError(t, <-errs, "failed")
+	assert.True(t, errors.Is(<-errs, ErrMarshal))
+	var result string
+	require.NoError(t, c.ReadJSON(&result))
+	assert.Equal(t, "got ping", result)
+
+	other.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, _, err := other.ReadMessage()
+	assert.Error(t, err)
+}
+
+func TestBeamReadLimit(t *testing.T) {
+	t.Parallel()
+
+	reasons := make(chan error, 1)
+	b := New(
+		OptLogger(t.Logf),
+		OptReadLimit(10),
+		OptOnDisconnect(func(c *Client, reason error) { reasons <- reason }))
+	s := newServer(t, b)
+	c := connect(t, s)
+
+	require.NoError(t, c.WriteMessage(websocket.TextMessage, make([]byte, 100)))
+	assert.Equal(t, websocket.ErrReadLimit, <-reasons)
+	assert.Equal(t, 0, b.Count())
+}
+
+func TestBeamSendRateLimit(t *testing.T) {
+	t.Parallel()
+
+	b := New(OptLogger(t.Logf), OptSendRateLimit(20))
+	s := newServer(t, b)
+	c := connect(t, s)
+
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		require.NoError(t, b.Send(i))
+	}
+	// The messages are buffered, and written every 50ms.
+	for i := 0; i < 5; i++ {
+		var result int
+		require.NoError(t, c.ReadJSON(&result))
+		assert.Equal(t, i, result)
+	}
+	assert.GreaterOrEqual(t, int64(time.Since(start)), int64(150*time.Millisecond))
+	assert.Equal(t, uint64(0), b.Stats().TotalDropped)
+}
+
+func TestBeamReadRateLimit(t *testing.T) {
+	t.Parallel()
+
+	t.Run("discard", func(t *testing.T) {
+		t.Parallel()
+
+		received := make(chan string, 10)
+		b := New(
+			OptLogger(t.Logf),
+			OptReadRateLimit(2, false),
+			OptOnMessage(func(c *Client, messageType int, data []byte) { received <- string(data) }))
+		s := newServer(t, b)
+		c := connect(t, s)
+
+		for _, msg := range []string{"1", "2", "3", "4"} {
+			require.NoError(t, c.WriteMessage(websocket.TextMessage, []byte(msg)))
+		}
+		assert.Equal(t, "1", <-received)
+		assert.Equal(t, "2", <-received)
+
+		// The rest of the messages are discarded, and the client is still connected.
+		select {
+		case msg := <-received:
+			t.Errorf("Unexpected message: %s", msg)
+		case <-time.After(100 * time.Millisecond):
+		}
+		assert.Equal(t, 1, b.Count())
+	})
+
+	t.Run("disconnect", func(t *testing.T) {
+		t.Parallel()
+
+		reasons := make(chan error, 1)
+		b := New(
+			OptLogger(t.Logf),
+			OptReadRateLimit(2, true),
+			OptOnDisconnect(func(c *Client, reason error) { reasons <- reason }))
+		s := newServer(t, b)
+		c := connect(t, s)
+
+		for _, msg := range []string{"1", "2", "3"} {
+			require.NoError(t, c.WriteMessage(websocket.TextMessage, []byte(msg)))
+		}
+		_, _, err := c.ReadMessage()
+		assert.True(t, websocket.IsCloseError(err, websocket.ClosePolicyViolation), "got: %v", err)
+		assert.Equal(t, ErrReadRateLimit, <-reasons)
+	})
+}
+
+func TestBeamPause(t *testing.T) {
+	t.Parallel()
+
+	b := New(OptLogger(t.Logf), OptRetainLast())
+	s := newServer(t, b)
+	c1 := connect(t, s)
+
+	b.Pause()
+	delivered, dropped, err := b.SendReport("paused")
+	require.NoError(t, err)
+	assert.Equal(t, 0, delivered)
+	assert.Equal(t, 0, dropped)
+
+	// New connections get the message that was retained during the pause.
+	c2 := connect(t, s)
+	var result string
+	require.NoError(t, c2.ReadJSON(&result))
+	assert.Equal(t, "paused", result)
+
+	b.Resume()
+	require.NoError(t, b.Send("resumed"))
+
+	// The first client should get only the message that was sent after the pause.
+	require.NoError(t, c1.ReadJSON(&result))
+	assert.Equal(t, "resumed", result)
+	require.NoError(t, c2.ReadJSON(&result))
+	assert.Equal(t, "resumed", result)
+}
+
+func TestBeamIdleTimeout(t *testing.T) {
+	t.Parallel()
+
+	reasons := make(chan error, 2)
+	b := New(
+		OptLogger(t.Logf),
+		OptIdleTimeout(100*time.Millisecond),
+		OptOnDisconnect(func(c *Client, reason error) { reasons <- reason }))
+	s := newServer(t, b)
+	active := connectURL(t, s, s.URL+"?topic=active")
+	idle := connect(t, s)
+
+	// Keep the first connection active for longer than the idle timeout.
+	for i := 0; i < 5; i++ {
+		require.NoError(t, b.SendTo("active", i))
+		var result int
+		require.NoError(t, active.ReadJSON(&result))
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// Only the idle connection should be closed.
+	_, _, err := idle.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseNormalClosure), "got: %v", err)
+	assert.Equal(t, ErrIdleTimeout, <-reasons)
+	assert.Equal(t, 1, b.Count())
+}
+
+func TestBeamBaseContext(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	reasons := make(chan error, 2)
+	errs := make(chan error, 10)
+	b := New(
+		OptLogger(t.Logf),
+		OptBaseContext(func(r *http.Request) context.Context {
+			if r.URL.Query().Get("topic") == "app" {
+				return ctx
+			}
+			return context.Background()
+		}),
+		OptOnDisconnect(func(c *Client, reason error) { reasons <- reason }),
+		OptOnError(func(c *Client, err error) { errs <- err }))
+	s := newServer(t, b)
+	app := connectURL(t, s, s.URL+"?topic=app")
+	other := connect(t, s)
+
+	// Only the connection with the cancelled context should be closed.
+	cancel()
+	_, _, err := app.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseGoingAway), "got: %v", err)
+	assert.Equal(t, context.Canceled, <-reasons)
+	assert.Equal(t, 1, b.Count())
+
+	require.NoError(t, b.Send("test"))
+	var result string
+	require.NoError(t, other.ReadJSON(&result))
+	assert.Equal(t, "test", result)
+
+	// A done context is a normal disconnection, and not an error.
+	assert.Empty(t, errs)
+}
+
+func TestBeamOnError(t *testing.T) {
+	t.Parallel()
+
+	errs := make(chan error, 1)
+	b := New(OptLogger(nil), OptOnError(func(c *Client, err error) {
+		assert.NotEmpty(t, c.Addr())
+		errs <- err
+	}))
+	s := newServer(t, b)
+
+	// A request without a websocket upgrade fails.
+	resp, err := http.Get(strings.Replace(s.URL, "ws", "http", 1))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Error(t, <-errs)
+}
+
+func TestBeamOnErrorRead(t *testing.T) {
+	t.Parallel()
+
+	errs := make(chan error, 1)
+	b := New(
+		OptLogger(t.Logf),
+		OptReadLimit(10),
+		OptOnError(func(c *Client, err error) {
+			select {
+			case errs <- err:
+			default:
+			}
+		}))
+	s := newServer(t, b)
+	c := connect(t, s)
+
+	// A message that exceeds the read limit fails the connection's reading.
+	require.NoError(t, c.WriteMessage(websocket.TextMessage, []byte(strings.Repeat("a", 100))))
+	assert.True(t, errors.Is(<-errs, websocket.ErrReadLimit))
+}
+
+func TestBeamHealthy(t *testing.T) {
+	t.Parallel()
+
+	b := New(OptLogger(t.Logf))
+	h := b.HealthHandler()
+	status := func() int {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest(http.MethodGet, "/health", nil))
+		return w.Code
+	}
+
+	assert.True(t, b.Healthy())
+	assert.Equal(t, http.StatusOK, status())
+
+	b.Pause()
+	assert.False(t, b.Healthy())
+	assert.Equal(t, http.StatusServiceUnavailable, status())
+
+	b.Resume()
+	assert.True(t, b.Healthy())
+
+	require.NoError(t, b.Close())
+	assert.False(t, b.Healthy())
+	assert.Equal(t, http.StatusServiceUnavailable, status())
+}
+
+func TestBeamDebugHandler(t *testing.T) {
+	t.Parallel()
+
+	b := New(OptLogger(t.Logf), OptBuffer(10))
+	s := newServer(t, b)
+	c := connect(t, s)
+	b.Pause()
+
+	w := httptest.NewRecorder()
+	b.DebugHandler()(w, httptest.NewRequest(http.MethodGet, "/debug", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+
+	var state struct {
+		Connected int
+		Paused    bool
+		Closed    bool
+		Clients   []struct {
+			Addr     string
+			QueueCap int `json:"queue_cap"`
+			Age      string
+		}
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &state))
+	assert.Equal(t, 1, state.Connected)
+	assert.True(t, state.Paused)
+	assert.False(t, state.Closed)
+	require.Len(t, state.Clients, 1)
+	assert.Equal(t, c.LocalAddr().String(), state.Clients[0].Addr)
+	assert.Equal(t, 10, state.Clients[0].QueueCap)
+	_, err := time.ParseDuration(state.Clients[0].Age)
+	assert.NoError(t, err)
+}
+
+func TestBeamUpgrade(t *testing.T) {
+	t.Parallel()
+
+	b := New(OptLogger(t.Logf))
+	s := newHandlerServer(t, b, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := b.Upgrade(w, r)
+		if err != nil {
+			return
+		}
+		if r.URL.Query().Get("close") != "" {
+			assert.NoError(t, c.Close())
+			return
+		}
+		c.Serve()
+		assert.Error(t, c.Serve())
+		assert.Error(t, c.Close())
+	}))
+	url := strings.Replace(s.URL, "http", "ws", 1)
+
+	// A served client gets messages.
+	c := connectURL(t, s, url)
+	require.NoError(t, b.Send("test"))
+	var result string
+	require.NoError(t, c.ReadJSON(&result))
+	assert.Equal(t, "test", result)
+
+	// A closed client gets a close message.
+	closed, _, err := websocket.DefaultDialer.Dial(url+"?close=1", nil)
+	require.NoError(t, err)
+	defer closed.Close()
+	_, _, err = closed.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseGoingAway), "got: %v", err)
+
+	// Clients that are not upgraded can't be served.
+	assert.Error(t, (&Client{}).Serve())
+}
+
+func TestBeamUpgradeRejected(t *testing.T) {
+	t.Parallel()
+
+	errs := make(chan error, 1)
+	b := New(
+		OptLogger(t.Logf),
+		OptMaxConnections(1),
+		OptAuthorize(func(r *http.Request) error {
+			if r.URL.Query().Get("token") != "valid" {
+				return errors.New("invalid token")
+			}
+			return nil
+		}))
+	s := newHandlerServer(t, b, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := b.Upgrade(w, r)
+		if err != nil {
+			errs <- err
+			return
+		}
+		c.Serve()
+	}))
+	url := strings.Replace(s.URL, "http", "ws", 1)
+
+	// The error of the authorizer is the rejection reason.
+	_, _, err := websocket.DefaultDialer.Dial(url, nil)
+	require.Error(t, err)
+	err = <-errs
+	assert.True(t, errors.Is(err, ErrRejected))
+	assert.EqualError(t, err, "connection rejected: invalid token")
+
+	connectURL(t, s, url+"?token=valid")
+	// The connection that exceeds the limit is closed by the beam after the handshake.
+	c, _, err := websocket.DefaultDialer.Dial(url+"?token=valid", nil)
+	require.NoError(t, err)
+	defer c.Close()
+	assert.True(t, errors.Is(<-errs, ErrRejected))
+}
+
+func TestBeamResumable(t *testing.T) {
+	t.Parallel()
+
+	clients := make(chan *Client, 1)
+	b := New(OptLogger(t.Logf), OptResumable(time.Minute))
+	s := newHandlerServer(t, b, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := b.Upgrade(w, r)
+		if err != nil {
+			return
+		}
+		// The first connection is not served, such that its messages are not written.
+		if r.URL.Query().Get("resume") == "" {
+			clients <- c
+			return
+		}
+		c.Serve()
+	}))
+	url := strings.Replace(s.URL, "http", "ws", 1)
+
+	first, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	defer first.Close()
+	p := <-clients
+	token := resp.Header.Get(ResumeHeader)
+	assert.NotEmpty(t, token)
+	assert.Equal(t, token, p.ResumeToken())
+
+	require.NoError(t, b.Send("first"))
+	require.NoError(t, b.Send("second"))
+	require.NoError(t, p.Close())
+
+	// The resumed connection gets the messages that were not written before any other message.
+	c, resp, err := websocket.DefaultDialer.Dial(url+"?resume="+token, nil)
+	require.NoError(t, err)
+	defer c.Close()
+	assert.NotEqual(t, token, resp.Header.Get(ResumeHeader))
+	waitAdded(t, s, c)
+	require.NoError(t, b.Send("third"))
+	for _, want := range []string{"first", "second", "third"} {
+		var result string
+		require.NoError(t, c.ReadJSON(&result))
+		assert.Equal(t, want, result)
+	}
+
+	// A token can be used only once.
+	b.lock.Lock()
+	assert.Empty(t, b.suspended)
+	b.lock.Unlock()
+}
+
+func TestBeamClose(t *testing.T) {
+	t.Parallel()
+
+	b := New(OptLogger(t.Logf))
+	s := newServer(t, b)
+	c := connect(t, s)
+
+	require.NoError(t, b.Close())
+	assert.Equal(t, 0, b.Count())
+
+	// Connected client should get a close message.
+	_, _, err := c.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseGoingAway), "got: %v", err)
+
+	// Sending on a closed beam should fail.
+	assert.Equal(t, ErrClosed, b.Send("test"))
+
+	// New connections should be rejected.
+	_, resp, err := websocket.DefaultDialer.Dial(s.URL, nil)
+	require.Error(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+
+	// Closing again should not fail.
+	require.NoError(t, b.Close())
+}
+
+func TestBeamMaxConnections(t *testing.T) {
+	t.Parallel()
+	const count = 5
+
+	b := New(OptLogger(t.Logf), OptMaxConnections(count))
+	s := newServer(t, b)
+
+	for i := 0; i < count; i++ {
+		connect(t, s)
+	}
+
+	c, _, err := websocket.DefaultDialer.Dial(s.URL, nil)
+	require.NoError(t, err)
+	_, _, err = c.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseTryAgainLater), "got: %v", err)
+	assert.Equal(t, count, b.Count())
+}
+
+func TestBeamMaxConnectionsPerIP(t *testing.T) {
+	t.Parallel()
+
+	b := New(OptLogger(t.Logf), OptMaxConnectionsPerIP(1), OptTrustForwardedFor())
+	s := newServer(t, b)
+	dial := func(ip string) (*websocket.Conn, *http.Response, error) {
+		return websocket.DefaultDialer.Dial(s.URL, http.Header{"X-Forwarded-For": {"10.0.0.1, " + ip}})
+	}
+
+	c, _, err := dial("1.1.1.1")
+	require.NoError(t, err)
+	waitAdded(t, s, c)
+
+	_, resp, err := dial("1.1.1.1")
+	assert.Equal(t, websocket.ErrBadHandshake, err)
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+
+	// Other IPs are not limited.
+	other, _, err := dial("2.2.2.2")
+	require.NoError(t, err)
+	defer other.Close()
+
+	// The connection count of the IP is decremented on disconnection.
+	c.Close()
+	deadline := time.Now().Add(time.Second)
+	for {
+		c, _, err = dial("1.1.1.1")
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Connection was not allowed after disconnection")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Close()
+}
+
+func TestBeamRetryAfter(t *testing.T) {
+	t.Parallel()
+
+	b := New(
+		OptLogger(t.Logf),
+		OptMaxConnections(1),
+		OptRetryAfter(func() time.Duration { return 1500 * time.Millisecond }))
+	s := newServer(t, b)
+	sse := newHandlerServer(t, b, b.SSEHandler())
+	connect(t, s)
+
+	// The websocket connection is closed after the handshake, with the retry time in the reason.
+	c, resp, err := websocket.DefaultDialer.Dial(s.URL, nil)
+	require.NoError(t, err)
+	defer c.Close()
+	assert.Empty(t, resp.Header.Get("Retry-After"))
+	_, _, err = c.ReadMessage()
+	var closeErr *websocket.CloseError
+	require.True(t, errors.As(err, &closeErr), "got: %v", err)
+	assert.Equal(t, websocket.CloseTryAgainLater, closeErr.Code)
+	assert.Equal(t, "connection rejected: too many connections, retry after 2s", closeErr.Text)
+
+	resp, err = http.Get(sse.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, "2", resp.Header.Get("Retry-After"))
+
+	// A closed beam rejects websocket connections with HTTP 503 status.
+	require.NoError(t, b.Close())
+	_, resp, err = websocket.DefaultDialer.Dial(s.URL, nil)
+	assert.Equal(t, websocket.ErrBadHandshake, err)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, "2", resp.Header.Get("Retry-After"))
+}
+
+func TestBeamRetryAfterPerIP(t *testing.T) {
+	t.Parallel()
+
+	b := New(
+		OptLogger(t.Logf),
+		OptMaxConnectionsPerIP(1),
+		OptRetryAfter(func() time.Duration { return time.Second }))
+	s := newServer(t, b)
+	sse := newHandlerServer(t, b, b.SSEHandler())
+	connect(t, s)
+
+	_, resp, err := websocket.DefaultDialer.Dial(s.URL, nil)
+	assert.Equal(t, websocket.ErrBadHandshake, err)
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, "1", resp.Header.Get("Retry-After"))
+
+	resp, err = http.Get(sse.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, "1", resp.Header.Get("Retry-After"))
+}
+
+func TestMux(t *testing.T) {
+	t.Parallel()
+
+	foo := New(OptLogger(t.Logf))
+	bar := New(OptLogger(t.Logf))
+	m := NewMux()
+	m.Add("foo", foo)
+	m.Add("bar", bar)
+	s := newHandlerServer(t, foo, m)
+	t.Cleanup(func() { bar.Close() })
+	url := strings.Replace(s.URL, "http", "ws", 1)
+
+	c, _, err := websocket.DefaultDialer.Dial(url+"?stream=foo", nil)
+	require.NoError(t, err)
+	defer c.Close()
+	for foo.Count() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, 0, bar.Count())
+
+	require.NoError(t, bar.Send("bar"))
+	require.NoError(t, foo.Send("foo"))
+	var result string
+	require.NoError(t, c.ReadJSON(&result))
+	assert.Equal(t, "foo", result)
+
+	_, resp, err := websocket.DefaultDialer.Dial(url+"?stream=unknown", nil)
+	assert.Equal(t, websocket.ErrBadHandshake, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestBeamEvictByKey(t *testing.T) {
+	t.Parallel()
+
+	reasons := make(chan error, 3)
+	b := New(
+		OptLogger(t.Logf),
+		OptEvictByKey(func(r *http.Request) string { return r.URL.Query().Get("user") }),
+		OptOnDisconnect(func(c *Client, reason error) { reasons <- reason }))
+	s := newServer(t, b)
+	old := connectURL(t, s, s.URL+"?user=a")
+	connectURL(t, s, s.URL+"?user=b")
+	connectURL(t, s, s.URL+"?user=a")
+
+	// The old connection of the same user should be evicted.
+	_, _, err := old.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.ClosePolicyViolation), "got: %v", err)
+	assert.Equal(t, ErrEvicted, <-reasons)
+	assert.Equal(t, 2, b.Count())
+}
+
+func TestBeamAuthorize(t *testing.T) {
+	t.Parallel()
+
+	b := New(
+		OptLogger(t.Logf),
+		OptAuthorize(func(r *http.Request) error {
+			switch r.URL.Query().Get("token") {
+			case "valid":
+				return nil
+			case "banned":
+				return statusError(http.StatusForbidden)
+			default:
+				return errors.New("invalid token")
+			}
+		}))
+	s := newServer(t, b)
+
+	_, resp, err := websocket.DefaultDialer.Dial(s.URL+"?token=invalid", nil)
+	require.Error(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	_, resp, err = websocket.DefaultDialer.Dial(s.URL+"?token=banned", nil)
+	require.Error(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.Equal(t, 0, b.Count())
+
+	connectURL(t, s, s.URL+"?token=valid")
+	assert.Equal(t, 1, b.Count())
+}
+
+func TestBeamAuthorizeFirst(t *testing.T) {
+	t.Parallel()
+
+	var (
+		mu     sync.Mutex
+		called []string
+	)
+	record := func(name string) {
+		mu.Lock()
+		defer mu.Unlock()
+		called = append(called, name)
+	}
+
+	b := New(
+		OptLogger(t.Logf),
+		OptAuthorize(func(r *http.Request) error { return errors.New("invalid token") }),
+		OptBufferFunc(func(r *http.Request) int { record("buffer"); return -1 }),
+		OptRemoteAddr(func(r *http.Request) string { record("remote addr"); return r.RemoteAddr }),
+		OptBaseContext(func(r *http.Request) context.Context { record("base context"); return r.Context() }),
+		OptTags(func(r *http.Request) []string { record("tags"); return nil }))
+	s := newServer(t, b)
+
+	_, resp, err := websocket.DefaultDialer.Dial(s.URL, nil)
+	require.Error(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Empty(t, called)
+}
+
+// statusError is an error that has an HTTP status code.
+type statusError int
+
+func (e statusError) Error() string   { return http.StatusText(int(e)) }
+func (e statusError) StatusCode() int { return int(e) }
+
+func TestBeamNoCloseHandshake(t *testing.T) {
+	t.Parallel()
+
+	b := New(OptLogger(t.Logf), OptNoCloseHandshake())
+	s := newServer(t, b)
+	c := connect(t, s)
+
+	require.NoError(t, b.Close())
+
+	// The connection should be closed without a close message.
+	_, _, err := c.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseAbnormalClosure), "got: %v", err)
+}
+
+func TestBeamCloseMessage(t *testing.T) {
+	t.Parallel()
+
+	b := New(OptLogger(t.Logf), OptCloseMessage(websocket.CloseServiceRestart, "restarting"))
+	s := newServer(t, b)
+	c := connect(t, s)
+
+	require.NoError(t, b.Close())
+
+	_, _, err := c.ReadMessage()
+	var closeErr *websocket.CloseError
+	require.True(t, errors.As(err, &closeErr), "got: %v", err)
+	assert.Equal(t, websocket.CloseServiceRestart, closeErr.Code)
+	assert.Equal(t, "restarting", closeErr.Text)
+}
+
+func TestBeamAllowedOrigins(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		origins []string
+		origin  string
+		want    int
+	}{
+		{origins: []string{"https://a.com"}, origin: "https://a.com", want: http.StatusSwitchingProtocols},
+		{origins: []string{"https://a.com", "https://b.com"}, origin: "https://B.com", want: http.StatusSwitchingProtocols},
+		{origins: []string{"https://a.com"}, origin: "", want: http.StatusSwitchingProtocols},
+		{origins: []string{"*"}, origin: "https://b.com", want: http.StatusSwitchingProtocols},
+		{origins: []string{"https://a.com"}, origin: "https://b.com", want: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		b := New(OptLogger(t.Logf), OptAllowedOrigins(tt.origins...))
+		s := newServer(t, b)
+
+		header := http.Header{}
+		if tt.origin != "" {
+			header.Set("Origin", tt.origin)
+		}
+		c, resp, _ := websocket.DefaultDialer.Dial(s.URL, header)
+		assert.Equal(t, tt.want, resp.StatusCode, "origins: %v, origin: %s", tt.origins, tt.origin)
+		if c != nil {
+			c.Close()
+		}
+	}
+}
+
+func TestBeamDisconnectAll(t *testing.T) {
+	t.Parallel()
+
+	reasons := make(chan error, 2)
+	b := New(OptLogger(t.Logf), OptOnDisconnect(func(c *Client, reason error) { reasons <- reason }))
+	s := newServer(t, b)
+	c1 := connect(t, s)
+	c2 := connect(t, s)
+
+	// Read the close messages concurrently, since the closing handshake waits for the clients.
+	errs := make(chan error, 2)
+	for _, c := range []*websocket.Conn{c1, c2} {
+		c := c
+		go func() {
+			_, _, err := c.ReadMessage()
+			errs <- err
+		}()
+	}
+
+	b.DisconnectAll(websocket.CloseServiceRestart, "restart")
+	assert.Equal(t, 0, b.Count())
+	for i := 0; i < 2; i++ {
+		err := <-errs
+		assert.True(t, websocket.IsCloseError(err, websocket.CloseServiceRestart), "got: %v", err)
+		assert.Equal(t, ErrDisconnectAll, <-reasons)
+	}
+
+	// The beam keeps accepting connections.
+	c := connect(t, s)
+	require.NoError(t, b.Send("test"))
+	var result string
+	require.NoError(t, c.ReadJSON(&result))
+	assert.Equal(t, "test", result)
+}
+
+func TestBeamEvictOldest(t *testing.T) {
+	t.Parallel()
+
+	reasons := make(chan error, 2)
+	clients := make(chan *Client, 3)
+	b := New(
+		OptLogger(t.Logf),
+		OptOnConnect(func(c *Client) { clients <- c }),
+		OptOnDisconnect(func(c *Client, reason error) { reasons <- reason }))
+	s := newServer(t, b)
+	var conns []*websocket.Conn
+	for i := 0; i < 3; i++ {
+		conns = append(conns, connect(t, s))
+		time.Sleep(10 * time.Millisecond)
+	}
+	for i := 0; i < 3; i++ {
+		assert.Greater(t, int64((<-clients).Age()), int64(0))
+	}
+
+	b.EvictOldest(2)
+	for _, c := range conns[:2] {
+		_, _, err := c.ReadMessage()
+		assert.True(t, websocket.IsCloseError(err, websocket.CloseTryAgainLater), "got: %v", err)
+		assert.Equal(t, ErrEvictedOldest, <-reasons)
+	}
+	assert.Equal(t, []string{conns[2].LocalAddr().String()}, b.Clients())
+}
+
+func TestBeamShutdown(t *testing.T) {
+	t.Parallel()
+	const count = 10
+
+	b := New(OptLogger(t.Logf))
+	s := newServer(t, b)
+	c := connect(t, s)
+
+	for i := 0; i < count; i++ {
+		require.NoError(t, b.Send(i))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- b.Shutdown(ctx) }()
+
+	// All buffered messages should be received before the close message.
+	for i := 0; i < count; i++ {
+		var result int
+		require.NoError(t, c.ReadJSON(&result))
+		assert.Equal(t, i, result)
+	}
+	_, _, err := c.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseGoingAway), "got: %v", err)
+
+	require.NoError(t, <-shutdown)
+	assert.Equal(t, ErrClosed, b.Send("test"))
+}
+
+func TestBeamShutdownTimeout(t *testing.T) {
+	t.Parallel()
+
+	// Block the serving goroutine from reading messages from the buffer.
+	block := make(chan struct{})
+	defer close(block)
+
+	b := New(OptLogger(t.Logf), OptOnConnect(func(*Client) { <-block }))
+	s := newServer(t, b)
+	c := connect(t, s)
+
+	require.NoError(t, b.Send("test"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, b.Shutdown(ctx))
+
+	// The connection should be closed forcibly.
+	_, _, err := c.ReadMessage()
+	assert.Error(t, err)
+}
+
+func TestBeamRetainLast(t *testing.T) {
+	t.Parallel()
+
+	b := New(OptLogger(t.Logf), OptRetainLast())
+	s := newServer(t, b)
+
+	// Before any message was sent, nothing is sent to new connections.
+	c := connect(t, s)
+	c.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, _, err := c.ReadMessage()
+	assert.Error(t, err)
+
+	require.NoError(t, b.Send("first"))
+	require.NoError(t, b.Send("second"))
+	require.NoError(t, b.SendTo("topic", "third"))
+
+	// Only the last message to all connections is sent to new connections.
+	c = connect(t, s)
+	var result string
+	require.NoError(t, c.ReadJSON(&result))
+	assert.Equal(t, "second", result)
+}
+
+func TestBeamInitialMessage(t *testing.T) {
+	t.Parallel()
+
+	b := New(
+		OptLogger(t.Logf),
+		OptInitialMessage(func(c *Client) (interface{}, error) {
+			user := c.Metadata()["user"]
+			if user == "" {
+				return nil, errors.New("no state")
+			}
+			return "state of " + user.(string), nil
+		}),
+		OptConnectMetadata(func(r *http.Request) (map[string]interface{}, error) {
+			return map[string]interface{}{"user": r.URL.Query().Get("user")}, nil
+		}))
+	s := newServer(t, b)
+
+	c := connectURL(t, s, s.URL+"?user=a")
+	require.NoError(t, b.Send("test"))
+
+	var result string
+	require.NoError(t, c.ReadJSON(&result))
+	assert.Equal(t, "state of a", result)
+	require.NoError(t, c.ReadJSON(&result))
+	assert.Equal(t, "test", result)
+
+	// Failing initial message closes the connection.
+	c, _, err := websocket.DefaultDialer.Dial(s.URL, nil)
+	require.NoError(t, err)
+	_, _, err = c.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseInternalServerErr), "got: %v", err)
+}
+
+func TestBeamStats(t *testing.T) {
+	t.Parallel()
+
+	// Block the serving goroutine of connections with a topic from reading messages from the
+	// buffer.
+	block := make(chan struct{})
+	defer close(block)
+
+	b := New(
+		OptLogger(t.Logf),
+		OptBuffer(1),
+		OptOnConnect(func(c *Client) {
+			if len(c.Topics()) > 0 {
+				<-block
+			}
+		}))
+	s := newServer(t, b)
+
+	c1 := connect(t, s)
+	connectURL(t, s, s.URL+"?topic=blocked")
+
+	require.NoError(t, b.Send("first"))
+	require.NoError(t, b.Send("second"))
+
+	var result string
+	require.NoError(t, c1.ReadJSON(&result))
+	require.NoError(t, c1.ReadJSON(&result))
+
+	// Give server time to clear the first connection.
+	c1.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	assert.Equal(t, Stats{
+		Connected:        1,
+		TotalConnections: 2,
+		TotalSent:        2,
+		TotalDropped:     1,
+	}, b.Stats())
+}
+
+func TestBeamFailedUpgrade(t *testing.T) {
+	t.Parallel()
+
+	b := New(OptLogger(t.Logf), OptMaxConnections(1))
+	s := newServer(t, b)
+
+	// A request that is not a websocket upgrade should fail, and should not add a connection or
+	// take a place from the maximum connections.
+	for i := 0; i < 2; i++ {
+		resp, err := http.Get(strings.Replace(s.URL, "ws", "http", 1))
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		assert.Equal(t, 0, b.Count())
+	}
+
+	connect(t, s)
+	assert.Equal(t, 1, b.Count())
+}
+
+func TestBeamSSE(t *testing.T) {
+	t.Parallel()
+
+	b := New(OptLogger(t.Logf))
+	s := newServer(t, b)
+	c := connect(t, s)
+
+	sse := newHandlerServer(t, b, b.SSEHandler())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, sse.URL, nil)
+	require.NoError(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	assert.Equal(t, 2, b.Count())
+
+	require.NoError(t, b.Send("test"))
+	require.NoError(t, b.SendText("foo\nbar"))
+
+	// Both the websocket and the SSE clients should get the messages.
+	var result string
+	require.NoError(t, c.ReadJSON(&result))
+	assert.Equal(t, "test", result)
+
+	r := bufio.NewReader(resp.Body)
+	readEvent := func() string {
+		var event string
+		for {
+			line, err := r.ReadString('\n')
+			require.NoError(t, err)
+			event += line
+			if line == "\n" {
+				return event
+			}
+		}
+	}
+	assert.Equal(t, "data: \"test\"\n\n", readEvent())
+	assert.Equal(t, "data: foo\ndata: bar\n\n", readEvent())
+
+	// Disconnecting the SSE client should remove it from the beam.
+	cancel()
+	deadline := time.Now().Add(time.Second)
+	for b.Count() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("SSE connection was not removed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestBeamNoGoroutineLeak(t *testing.T) {
+	// This test is not parallel, to not detect goroutines of other tests.
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+	b := New(OptLogger(t.Logf))
+	s := newServer(t, b)
+	c := connect(t, s)
+	defer c.Close()
+
+	require.NoError(t, b.Send("test"))
+	var result string
+	require.NoError(t, c.ReadJSON(&result))
+
+	// Closing the beam while the client is still connected should release all the server
+	// goroutines.
+	require.NoError(t, b.Close())
+	s.Close()
+}
+
+func TestBeamStructuredLogger(t *testing.T) {
+	t.Parallel()
+
+	type entry struct {
+		level  string
+		msg    string
+		fields map[string]interface{}
+	}
+	entries := make(chan entry, 10)
+	b := New(OptStructuredLogger(func(level, msg string, fields map[string]interface{}) {
+		entries <- entry{level: level, msg: msg, fields: fields}
+	}))
+	s := newServer(t, b)
+	c := connect(t, s)
+
+	e := <-entries
+	assert.Equal(t, "debug", e.level)
+	assert.Equal(t, "New connection", e.msg)
+	assert.Equal(t, c.LocalAddr().String(), e.fields["addr"])
+}
+
+func TestBeamLoggerLevel(t *testing.T) {
+	t.Parallel()
+
+	lines := make(chan string, 100)
+	b := New(OptLogger(func(format string, args ...interface{}) { lines <- fmt.Sprintf(format, args...) }))
+	s := newServer(t, b)
+	c := connect(t, s)
+
+	assert.Equal(t, fmt.Sprintf("debug [%s] New connection", c.LocalAddr()), <-lines)
+
+	// A disconnection of the client is a debug event.
+	require.NoError(t, c.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")))
+	for line := range lines {
+		if strings.HasSuffix(line, "Client closed connection") {
+			assert.Equal(t, fmt.Sprintf("debug [%s] Client closed connection", c.LocalAddr()), line)
+			break
+		}
+	}
+}
+
+func TestBeamLogLevel(t *testing.T) {
+	t.Parallel()
+
+	type entry struct {
+		level string
+		msg   string
+	}
+	entries := make(chan entry, 10)
+	b := New(
+		OptLogLevel(LogInfo),
+		OptStructuredLogger(func(level, msg string, fields map[string]interface{}) {
+			entries <- entry{level: level, msg: msg}
+		}))
+	s := newServer(t, b)
+	c := connect(t, s)
+
+	// The debug events of the connection are not logged.
+	b.DisconnectAll(websocket.CloseNormalClosure, "")
+	_, _, err := c.ReadMessage()
+	require.Error(t, err)
+	assert.Equal(t, entry{level: "info", msg: "Disconnected all"}, <-entries)
+	assert.Equal(t, "warn", LogWarn.String())
+}
+
+func TestBeamNoLog(t *testing.T) {
+	t.Parallel()
+
+	b := New(OptLogger(nil))
+	s := newServer(t, b)
+	c := connect(t, s)
+
+	err := b.Send("test")
+	require.NoError(t, err)
+
+	var result string
+	err = c.ReadJSON(&result)
+	require.NoError(t, err)
+	assert.Equal(t, "test", result)
+}
+
+func TestBeamEncoder(t *testing.T) {
+	t.Parallel()
+
+	b := New(
+		OptLogger(t.Logf),
+		OptEncoder(func(v interface{}) ([]byte, int, error) {
+			return []byte(fmt.Sprint(v)), websocket.BinaryMessage, nil
+		}))
+	s := newServer(t, b)
+	c := connect(t, s)
+
+	require.NoError(t, b.Send(42))
+
+	messageType, data, err := c.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, websocket.BinaryMessage, messageType)
+	assert.Equal(t, "42", string(data))
+}
+
+func TestPrepare(t *testing.T) {
+	t.Parallel()
+
+	b := New(OptLogger(t.Logf))
+	s := newServer(t, b)
+	c := connect(t, s)
+
+	values := []interface{}{"<test>", 1, []int{1, 2}, map[string]string{"a": "b"}, nil}
+
+	for _, v := range values {
+		require.NoError(t, b.Send(v))
+
+		want, err := json.Marshal(v)
+		require.NoError(t, err)
+
+		_, got, err := c.ReadMessage()
+		require.NoError(t, err)
+		assert.Equal(t, string(want), string(got))
+	}
+}
+
+var benchData = map[string]interface{}{"name": "test", "values": []int{1, 2, 3, 4, 5}}
+
+func BenchmarkPrepare(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := prepareJSON(benchData, websocket.TextMessage); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkPrepareMarshal(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf, err := json.Marshal(benchData)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := prepareBytes(buf, websocket.TextMessage); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSend(b *testing.B) {
+	b.Run("sharded", func(b *testing.B) { benchmarkSend(b, shardCount) })
+	b.Run("single", func(b *testing.B) { benchmarkSend(b, 1) })
+}
+
+// benchmarkSend benchmarks concurrent sends to many pears, with the given number of shards.
+func benchmarkSend(b *testing.B, shards int) {
+	const count = 1000
+
+	beam := New(OptLogger(nil))
+	beam.shards = newShards(shards)
+	addBenchPears(b, beam, count)
+
+	msg, err := prepareJSON("test", websocket.TextMessage)
+	require.NoError(b, err)
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if err := beam.send("test", msg); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// BenchmarkSendWait compares enqueuing messages that wait for full buffers from the sending
+// goroutine and from parallel workers.
+func BenchmarkSendWait(b *testing.B) {
+	b.Run("serial", func(b *testing.B) { benchmarkSendWait(b, 1) })
+	b.Run("parallel", func(b *testing.B) { benchmarkSendWait(b, 8) })
+}
+
+func benchmarkSendWait(b *testing.B, workers int) {
+	const count = 1000
+
+	beam := New(OptLogger(nil), OptBuffer(1), OptParallelSend(workers))
+	addBenchPears(b, beam, count)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := beam.SendWait("test"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// addBenchPears adds pears that drain their buffers to the beam, and removes them when the benchmark
+// ends.
+func addBenchPears(b *testing.B, beam *Beam, count int) {
+	for i := 0; i < count; i++ {
+		p := &Client{
+			beam:    beam,
+			queue:   newQueue(beam.buffer, beam.buffer),
+			closing: make(chan struct{}),
+			done:    make(chan struct{}),
+		}
+		require.NoError(b, beam.reserve(p))
+		require.NoError(b, beam.add(p))
+		go func() {
+			for {
+				select {
+				case <-p.queue.out:
+				case <-p.queue.ready:
+					for _, ok := p.queue.pop(); ok; _, ok = p.queue.pop() {
+					}
+				case <-p.done:
+					return
+				}
+			}
+		}()
+		b.Cleanup(func() { beam.remove(p) })
+	}
+}
+
+// BenchmarkSendEmpty benchmarks sends to a beam without connections, which are discarded without
+// marshaling, unless the messages are retained.
+func BenchmarkSendEmpty(b *testing.B) {
+	b.Run("discarded", func(b *testing.B) { benchmarkSendEmpty(b, New(OptLogger(nil))) })
+	b.Run("retained", func(b *testing.B) { benchmarkSendEmpty(b, New(OptLogger(nil), OptRetainLast())) })
+}
+
+func benchmarkSendEmpty(b *testing.B, beam *Beam) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := beam.Send(benchData); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkBuffer compares the drop rate of static and dynamic buffers, for a connection that gets
+// bursts of messages and catches up between them.
+func BenchmarkBuffer(b *testing.B) {
+	b.Run("static", func(b *testing.B) { benchmarkBuffer(b, newQueue(16, 16)) })
+	b.Run("dynamic", func(b *testing.B) { benchmarkBuffer(b, newQueue(16, 1024)) })
+}
+
+func benchmarkBuffer(b *testing.B, q *queue) {
+	const burst = 256
+
+	msg, err := prepareJSON("test", websocket.TextMessage)
+	require.NoError(b, err)
+
+	dropped := 0
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if !q.push(msg) {
+			dropped++
+		}
+		// Catch up at the end of every burst.
+		if i%burst == burst-1 {
+			for _, ok := q.pop(); ok; _, ok = q.pop() {
+			}
+		}
+	}
+	b.ReportMetric(float64(dropped)/float64(b.N), "drops/msg")
+}
+
+func newServer(t *testing.T, b *Beam) *httptest.Server {
+	s := newHandlerServer(t, b, b)
+	s.URL = strings.Replace(s.URL, "http", "ws", 1)
+	return s
+}
+
+// newHandlerServer returns a server of a handler of the given beam. On cleanup, it closes the beam
+// and waits for all the requests to be served, such that they don't log after the test ends.
+func newHandlerServer(t *testing.T, b *Beam, h http.Handler) *httptest.Server {
+	th := &testHandler{beam: b, handler: h}
+	s := httptest.NewServer(th)
+	t.Cleanup(func() {
+		b.Close()
+		th.wg.Wait()
+		s.Close()
+	})
+	return s
+}
+
+// testHandler serves requests with a handler of a beam, and tracks the requests that are served.
+type testHandler struct {
+	beam    *Beam
+	handler http.Handler
+	wg      sync.WaitGroup
+}
+
+func (h *testHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.wg.Add(1)
+	defer h.wg.Done()
+	h.handler.ServeHTTP(w, r)
+}
+
+func connect(t *testing.T, s *httptest.Server) *websocket.Conn {
+	return connectURL(t, s, s.URL)
+}
+
+// connectURL connects to the beam server with the given URL, and waits until the beam adds the
+// connection.
+func connectURL(t *testing.T, s *httptest.Server, url string) *websocket.Conn {
+	c, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	// Closing the connection on cleanup keeps it referenced until the test ends, otherwise it may be
+	// closed when it is garbage collected.
+	t.Cleanup(func() { c.Close() })
+	waitAdded(t, s, c)
+	return c
+}
+
+// waitAdded waits until the beam of the server adds the given connection.
+func waitAdded(t *testing.T, s *httptest.Server, c *websocket.Conn) {
+	b := s.Config.Handler.(*testHandler).beam
+	deadline := time.Now().Add(time.Second)
+	for {
+		added := false
+		b.each(func(p *Client) bool {
+			added = p.Addr() == c.LocalAddr().String()
+			return !added
+		})
+		if added {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Connection was not added")
+		}
+		time.Sleep(time.Millisecond)
+	}
 }
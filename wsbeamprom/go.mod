@@ -0,0 +1,12 @@
+module github.com/posener/wsbeam/wsbeamprom
+
+go 1.15
+
+require (
+	github.com/gorilla/websocket v1.4.2
+	github.com/posener/wsbeam v0.0.0
+	github.com/prometheus/client_golang v1.11.1
+	github.com/stretchr/testify v1.4.0
+)
+
+replace github.com/posener/wsbeam => ../
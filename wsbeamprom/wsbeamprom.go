@@ -0,0 +1,72 @@
+// Package wsbeamprom provides a Prometheus collector for wsbeam beams.
+//
+// It is a separate module, such that the wsbeam package does not depend on the Prometheus client.
+//
+// Usage:
+//
+//	b := wsbeam.New()
+//	prometheus.MustRegister(wsbeamprom.NewCollector(b, nil))
+package wsbeamprom
+
+import (
+	"github.com/posener/wsbeam"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Collector collects metrics of a beam.
+type Collector struct {
+	beam *wsbeam.Beam
+
+	connected         *prometheus.Desc
+	connectionsOpened *prometheus.Desc
+	connectionsClosed *prometheus.Desc
+	messagesSent      *prometheus.Desc
+	messagesDropped   *prometheus.Desc
+}
+
+// NewCollector returns a collector of the given beam metrics. The labels are added to all the
+// metrics, and can be used to distinguish between multiple beams.
+func NewCollector(b *wsbeam.Beam, labels prometheus.Labels) *Collector {
+	return &Collector{
+		beam: b,
+		connected: prometheus.NewDesc(
+			"wsbeam_connections",
+			"Number of currently connected connections.",
+			nil, labels),
+		connectionsOpened: prometheus.NewDesc(
+			"wsbeam_connections_opened_total",
+			"Number of connections that were connected.",
+			nil, labels),
+		connectionsClosed: prometheus.NewDesc(
+			"wsbeam_connections_closed_total",
+			"Number of connections that were disconnected.",
+			nil, labels),
+		messagesSent: prometheus.NewDesc(
+			"wsbeam_messages_sent_total",
+			"Number of messages that were written to connections.",
+			nil, labels),
+		messagesDropped: prometheus.NewDesc(
+			"wsbeam_messages_dropped_total",
+			"Number of messages that were discarded due to full buffers.",
+			nil, labels),
+	}
+}
+
+// Describe implements the prometheus.Collector interface.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.connected
+	ch <- c.connectionsOpened
+	ch <- c.connectionsClosed
+	ch <- c.messagesSent
+	ch <- c.messagesDropped
+}
+
+// Collect implements the prometheus.Collector interface.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.beam.Stats()
+	ch <- prometheus.MustNewConstMetric(c.connected, prometheus.GaugeValue, float64(stats.Connected))
+	ch <- prometheus.MustNewConstMetric(c.connectionsOpened, prometheus.CounterValue, float64(stats.TotalConnections))
+	ch <- prometheus.MustNewConstMetric(c.connectionsClosed, prometheus.CounterValue, float64(stats.TotalConnections-uint64(stats.Connected)))
+	ch <- prometheus.MustNewConstMetric(c.messagesSent, prometheus.CounterValue, float64(stats.TotalSent))
+	ch <- prometheus.MustNewConstMetric(c.messagesDropped, prometheus.CounterValue, float64(stats.TotalDropped))
+}
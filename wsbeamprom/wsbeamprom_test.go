@@ -0,0 +1,63 @@
+package wsbeamprom
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/posener/wsbeam"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCollector(t *testing.T) {
+	t.Parallel()
+
+	b := wsbeam.New(wsbeam.OptLogger(t.Logf))
+	s := httptest.NewServer(b)
+	defer s.Close()
+
+	c, resp, err := websocket.DefaultDialer.Dial(strings.Replace(s.URL, "http", "ws", 1), nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+
+	// Wait for the beam to add the connection.
+	for b.Count() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	require.NoError(t, b.Send("test"))
+	var result string
+	require.NoError(t, c.ReadJSON(&result))
+
+	// Wait for the server to count the sent message.
+	for b.Stats().TotalSent == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	collector := NewCollector(b, prometheus.Labels{"beam": "test"})
+
+	want := `
+# HELP wsbeam_connections Number of currently connected connections.
+# TYPE wsbeam_connections gauge
+wsbeam_connections{beam="test"} 1
+# HELP wsbeam_connections_closed_total Number of connections that were disconnected.
+# TYPE wsbeam_connections_closed_total counter
+wsbeam_connections_closed_total{beam="test"} 0
+# HELP wsbeam_connections_opened_total Number of connections that were connected.
+# TYPE wsbeam_connections_opened_total counter
+wsbeam_connections_opened_total{beam="test"} 1
+# HELP wsbeam_messages_dropped_total Number of messages that were discarded due to full buffers.
+# TYPE wsbeam_messages_dropped_total counter
+wsbeam_messages_dropped_total{beam="test"} 0
+# HELP wsbeam_messages_sent_total Number of messages that were written to connections.
+# TYPE wsbeam_messages_sent_total counter
+wsbeam_messages_sent_total{beam="test"} 1
+`
+	assert.NoError(t, testutil.CollectAndCompare(collector, strings.NewReader(want)))
+}
@@ -0,0 +1,176 @@
+// Package wsbeamtest provides utilities for testing code that uses wsbeam beams.
+//
+// It connects clients to a beam over in-memory pipes, without a network or an HTTP server.
+//
+// Usage:
+//
+//	b := wsbeam.New()
+//	c, err := wsbeamtest.Connect(b)
+//	if err != nil {
+//		t.Fatal(err)
+//	}
+//	defer c.Close()
+//
+//	b.Send("hello")
+//	var msg string
+//	c.ReadJSON(&msg)
+package wsbeamtest
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+
+	"github.com/gorilla/websocket"
+	"github.com/posener/wsbeam"
+)
+
+// bufferSize is the read and write buffer size of the client connections.
+const bufferSize = 1024
+
+// nextAddr is used to give every connection a unique remote address.
+var nextAddr uint64
+
+// FakeClient is a websocket client that is connected to a beam over an in-memory pipe.
+type FakeClient struct {
+	*websocket.Conn
+	// done is closed when the beam stopped serving the connection.
+	done chan struct{}
+}
+
+// Connect connects a new client to the beam, with a request to the root path. It returns after the
+// beam added the connection, such that the client receives any message that is sent after it
+// returns.
+func Connect(b *wsbeam.Beam) (*FakeClient, error) {
+	return ConnectRequest(b, httptest.NewRequest(http.MethodGet, "/", nil))
+}
+
+// ConnectRequest connects a new client to the beam, with the given request. The request can be used
+// to set the URL query and the headers that the beam options inspect. The websocket handshake
+// headers, the URL scheme and the remote address of the request are set by this function. If the
+// beam rejected the connection before the handshake, for example by `wsbeam.OptAuthorize` or
+// because the beam is closed, the returned error is `websocket.ErrBadHandshake`. If it closed the
+// connection after the handshake, for example when it has too many connections, the returned error
+// is "connection was closed by the beam".
+func ConnectRequest(b *wsbeam.Beam, r *http.Request) (*FakeClient, error) {
+	server, client := net.Pipe()
+	addr := fmt.Sprintf("wsbeamtest:%d", atomic.AddUint64(&nextAddr, 1))
+	c := &FakeClient{done: make(chan struct{})}
+	added := make(chan struct{})
+
+	go func() {
+		defer close(c.done)
+		defer server.Close()
+		serve(b, server, addr, added)
+	}()
+
+	u := *r.URL
+	u.Scheme = "ws"
+	if u.Host == "" {
+		u.Host = r.Host
+	}
+	conn, _, err := websocket.NewClient(client, &u, r.Header, bufferSize, bufferSize)
+	if err != nil {
+		client.Close()
+		<-c.done
+		return nil, err
+	}
+	c.Conn = conn
+
+	// The beam adds the connection only after the handshake is completed.
+	select {
+	case <-added:
+		return c, nil
+	case <-c.done:
+		conn.Close()
+		return nil, errors.New("connection was closed by the beam")
+	}
+}
+
+// Close closes the client connection, and waits for the beam to stop serving it.
+func (c *FakeClient) Close() error {
+	err := c.Conn.Close()
+	<-c.done
+	return err
+}
+
+// serve reads a single request from the server side of the pipe and serves it with the beam. The
+// added channel is closed when the beam added the connection.
+func serve(b *wsbeam.Beam, conn net.Conn, addr string, added chan<- struct{}) {
+	br := bufio.NewReader(conn)
+	r, err := http.ReadRequest(br)
+	if err != nil {
+		return
+	}
+	r.RemoteAddr = addr
+
+	w := &responseWriter{
+		conn:   conn,
+		rw:     bufio.NewReadWriter(br, bufio.NewWriter(conn)),
+		header: http.Header{},
+	}
+	p, err := b.Upgrade(w, r)
+	if err != nil {
+		if !w.hijacked {
+			w.flush(r)
+		}
+		return
+	}
+	close(added)
+	p.Serve()
+}
+
+// responseWriter is an HTTP response writer over the server side of the pipe, that can be hijacked
+// for the websocket upgrade. A response that is not hijacked is written when the handler returns.
+type responseWriter struct {
+	conn     net.Conn
+	rw       *bufio.ReadWriter
+	header   http.Header
+	status   int
+	body     bytes.Buffer
+	hijacked bool
+}
+
+func (w *responseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *responseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *responseWriter) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.body.Write(p)
+}
+
+func (w *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if w.hijacked {
+		return nil, nil, http.ErrHijacked
+	}
+	w.hijacked = true
+	return w.conn, w.rw, nil
+}
+
+// flush writes the response to the connection.
+func (w *responseWriter) flush(r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	resp := http.Response{
+		StatusCode:    w.status,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Request:       r,
+		Header:        w.header,
+		ContentLength: int64(w.body.Len()),
+		Body:          io.NopCloser(&w.body),
+	}
+	resp.Write(w.conn)
+}
@@ -0,0 +1,97 @@
+package wsbeamtest
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/posener/wsbeam"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnect(t *testing.T) {
+	t.Parallel()
+
+	b := wsbeam.New(wsbeam.OptLogger(t.Logf))
+	defer b.Close()
+
+	c1, err := Connect(b)
+	require.NoError(t, err)
+	defer c1.Close()
+	c2, err := Connect(b)
+	require.NoError(t, err)
+	defer c2.Close()
+
+	assert.Equal(t, 2, b.Count())
+	require.NoError(t, b.Send("test"))
+	for _, c := range []*FakeClient{c1, c2} {
+		var result string
+		require.NoError(t, c.ReadJSON(&result))
+		assert.Equal(t, "test", result)
+	}
+
+	require.NoError(t, c1.Close())
+	assert.Equal(t, 1, b.Count())
+}
+
+func TestConnectRemoteAddr(t *testing.T) {
+	t.Parallel()
+
+	b := wsbeam.New(
+		wsbeam.OptLogger(t.Logf),
+		wsbeam.OptRemoteAddr(func(r *http.Request) string { return r.Header.Get("X-Real-IP") }))
+	defer b.Close()
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("X-Real-IP", "10.0.0.1")
+	c, err := ConnectRequest(b, r)
+	require.NoError(t, err)
+	defer c.Close()
+	assert.Equal(t, []string{"10.0.0.1"}, b.Clients())
+}
+
+func TestConnectClosed(t *testing.T) {
+	t.Parallel()
+
+	b := wsbeam.New(wsbeam.OptLogger(t.Logf), wsbeam.OptMaxConnections(1))
+	defer b.Close()
+
+	c, err := Connect(b)
+	require.NoError(t, err)
+	defer c.Close()
+
+	// The beam rejects the connection that exceeds the limit after the handshake.
+	_, err = Connect(b)
+	assert.EqualError(t, err, "connection was closed by the beam")
+}
+
+func TestConnectRequest(t *testing.T) {
+	t.Parallel()
+
+	b := wsbeam.New(
+		wsbeam.OptLogger(t.Logf),
+		wsbeam.OptAuthorize(func(r *http.Request) error {
+			if r.Header.Get("Authorization") != "secret" {
+				return errors.New("unauthorized")
+			}
+			return nil
+		}))
+	defer b.Close()
+
+	r := httptest.NewRequest(http.MethodGet, "/?topic=a", nil)
+	_, err := ConnectRequest(b, r)
+	assert.Equal(t, websocket.ErrBadHandshake, err)
+
+	r.Header.Set("Authorization", "secret")
+	c, err := ConnectRequest(b, r)
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.NoError(t, b.SendTo("a", "test"))
+	var result string
+	require.NoError(t, c.ReadJSON(&result))
+	assert.Equal(t, "test", result)
+}